@@ -0,0 +1,121 @@
+package poolparty
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// An AdmissionController decides if a request may be dispatched to
+// the pool at all. Admit is called before a request waits for a worker,
+// if it returns an error that error is returned by Dispatch, otherwise
+// release is called once the request is complete.
+type AdmissionController interface {
+	Admit(req HTTPRequest) (release func(), err error)
+}
+
+// admitWaiter is implemented by admission controllers that may wait
+// before admitting a request. admitWait must give up once ctx is done
+// or closed is closed.
+type admitWaiter interface {
+	admitWait(ctx context.Context, closed <-chan struct{}, req HTTPRequest) (func(), error)
+}
+
+type boundedQueueAdmission struct {
+	slots chan struct{}
+}
+
+// NewBoundedQueueAdmission admits at most n outstanding requests
+// (waiting for a worker or being handled), additional requests fail
+// immediately with ErrWorkerPoolBusy.
+func NewBoundedQueueAdmission(n int) AdmissionController {
+	return &boundedQueueAdmission{
+		slots: make(chan struct{}, n),
+	}
+}
+
+func (a *boundedQueueAdmission) Admit(req HTTPRequest) (func(), error) {
+	select {
+	case a.slots <- struct{}{}:
+		return func() { <-a.slots }, nil
+	default:
+		return nil, ErrWorkerPoolBusy
+	}
+}
+
+type rateLimitAdmission struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	maxWait time.Duration
+	tokens  float64
+	last    time.Time
+}
+
+// NewRateLimitAdmission admits requests at an average of rate requests
+// per second with bursts of up to burst requests using a token bucket.
+// A request that would have to wait longer than maxWait for a token fails
+// immediately with ErrRateLimited, otherwise it waits for its token,
+// unless the pool is closed or the request times out first.
+func NewRateLimitAdmission(rate float64, burst int, maxWait time.Duration) (AdmissionController, error) {
+	if !(rate > 0) {
+		return nil, errors.New("rate limit must be positive")
+	}
+	return &rateLimitAdmission{
+		rate:    rate,
+		burst:   float64(burst),
+		maxWait: maxWait,
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}, nil
+}
+
+func (a *rateLimitAdmission) Admit(req HTTPRequest) (func(), error) {
+	return a.admitWait(context.Background(), nil, req)
+}
+
+func (a *rateLimitAdmission) admitWait(ctx context.Context, closed <-chan struct{}, req HTTPRequest) (func(), error) {
+	a.mu.Lock()
+
+	now := time.Now()
+	a.tokens += now.Sub(a.last).Seconds() * a.rate
+	if a.tokens > a.burst {
+		a.tokens = a.burst
+	}
+	a.last = now
+
+	// Tokens go negative while requests are waiting, each waiter has
+	// reserved the token it will use.
+	wait := time.Duration(0)
+	if a.tokens < 1 {
+		wait = time.Duration((1 - a.tokens) / a.rate * float64(time.Second))
+		if wait > a.maxWait {
+			a.mu.Unlock()
+			return nil, ErrRateLimited
+		}
+	}
+	a.tokens -= 1
+	a.mu.Unlock()
+
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		var err error
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-closed:
+			err = ErrWorkerPoolClosed
+		}
+		if err != nil {
+			// Hand back the token we reserved.
+			a.mu.Lock()
+			a.tokens += 1
+			a.mu.Unlock()
+			return nil, err
+		}
+	}
+	return func() {}, nil
+}
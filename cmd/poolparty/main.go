@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/andrewchambers/poolparty"
 	"github.com/andrewchambers/poolparty/textctl"
+	"github.com/anmitsu/go-shlex"
 	"github.com/go-logfmt/logfmt"
 	flag "github.com/spf13/pflag"
 	"github.com/valyala/fasthttp"
@@ -38,40 +43,169 @@ func (l *fasthttpLogAdaptor) Printf(format string, args ...interface{}) {
 	log("msg", fmt.Sprintf(format, args...))
 }
 
+func redactRequest(req poolparty.HTTPRequest) poolparty.HTTPRequest {
+	for k := range req.Headers {
+		switch strings.ToLower(k) {
+		case "authorization", "proxy-authorization", "cookie":
+			req.Headers[k] = "REDACTED"
+		}
+	}
+	return req
+}
+
 func main() {
+	defaults := poolparty.DefaultPoolConfig()
+
 	staticRoot := flag.String("static-root", "", "Path to serve static files from.")
 	staticNoBrotli := flag.Bool("static-no-brotli", false, "Don't use brotli compression.")
 	staticCompress := flag.Bool("static-compress", false, "Try to use compressed files or compress them if not already compressed.")
 	staticUrlPrefix := flag.String("static-url-prefix", "/static/", "Serve static files below this prefix.")
-	workerRendezvousTimeout := flag.Duration("worker-rendezvous-timeout", 60*time.Second, "Time to wait for a janet worker to accept a request.")
-	workerSpawnTimeout := flag.Duration("worker-spawn-timeout", 50*time.Millisecond, "Time to wait for a janet worker before spawning a new one to meet demand.")
-	workerRequestTimeout := flag.Duration("worker-request-timeout", 60*time.Second, "Time before a worker is considered crashed.")
-	workerRestartDelay := flag.Duration("worker-restart-delay", 1*time.Second, "Delay between worker restarts.")
-	workerHealthCheckInterval := flag.Duration("worker-health-check-interval", 120*time.Second, "Delay between worker health checks.")
+	workerRendezvousTimeout := flag.Duration("worker-rendezvous-timeout", defaults.WorkerRendezvousTimeout, "Time to wait for a janet worker to accept a request.")
+	workerSpawnTimeout := flag.Duration("worker-spawn-timeout", defaults.WorkerSpawnTimeout, "Time to wait for a janet worker before spawning a new one to meet demand.")
+	workerRequestTimeout := flag.Duration("worker-request-timeout", defaults.WorkerRequestTimeout, "Time before a worker is considered crashed.")
+	maxRequestTimeout := flag.Duration("max-request-timeout", 0, "Limit on how far worker heartbeats can extend the request timeout, 0 disables heartbeats.")
+	workerWriteTimeout := flag.Duration("worker-write-timeout", 0, "Time a worker may take to read a request before it is considered stuck, 0 leaves it to the request timeout.")
+	maxWorkerCPUTime := flag.Duration("max-worker-cpu-time", 0, "CPU time a worker may use handling one request before it is killed, rounded up to whole seconds (linux only), 0 means no limit.")
+	totalTimeout := flag.Duration("total-timeout", 0, "Limit on the time spent waiting for and being handled by a worker, 0 means no limit.")
+	workerHandshakeTimeout := flag.Duration("worker-handshake-timeout", defaults.WorkerHandshakeTimeout, "Time for a new worker to start and answer the protocol handshake, 0 uses the request timeout.")
+	workerRestartDelay := flag.Duration("worker-restart-delay", defaults.WorkerRestartDelay, "Delay between worker restarts.")
+	maxRestartsPerWindow := flag.Int("max-restarts-per-window", 0, "Log an alert and send a restart-guard-tripped event when more workers than this crash or fail to start within --restart-window, 0 disables.")
+	restartWindow := flag.Duration("restart-window", time.Minute, "Window for --max-restarts-per-window.")
+	stopRestartsOnTrip := flag.Bool("stop-restarts-on-trip", false, "Once --max-restarts-per-window trips, stop restarting crashed workers until reset-restart-guard is sent to the ctl socket.")
+	lameduckDuration := flag.Duration("lameduck-duration", 0, "On shutdown keep serving requests this long while the health check fails.")
+	compressResponses := flag.Bool("compress-responses", false, "Gzip worker responses for clients that accept it, unless the worker already set Content-Encoding.")
+	healthCheckPath := flag.String("health-check-path", "", "Serve a health check at this path, e.g. /healthz, it fails while starting and shutting down.")
+	retireGrace := flag.Duration("retire-grace", 0, "Time a worker removed from the pool may take to finish its current request before it is killed, 0 kills it straight away.")
+	workerShutdownTimeout := flag.Duration("worker-shutdown-timeout", defaults.WorkerShutdownTimeout, "Time to wait for a worker to exit before killing it, 0 waits forever.")
+	workerPrepareRecycleTimeout := flag.Duration("worker-prepare-recycle-timeout", 0, "Time to wait for a worker to acknowledge it is about to be replaced, 0 replaces workers without asking.")
+	workerHealthCheckInterval := flag.Duration("worker-health-check-interval", defaults.WorkerHealthCheckInterval, "Delay between worker health checks.")
+	workerHealthCheckJitter := flag.Float64("worker-health-check-jitter", defaults.WorkerHealthCheckJitter, "Randomly vary each health check delay by up to this fraction of the interval.")
 	readTimeout := flag.Duration("request-read-timeout", 60*time.Second, "Read timeout before an http request is aborted.")
 	writeTimeout := flag.Duration("request-write-timeout", 60*time.Second, "Write timeout before an http request is aborted.")
-	workerAttritionDelay := flag.Duration("worker-attrition-delay", 120*time.Second, "If no requests arrive in this period, a worker will be culled (down to the minimum pool size).")
-	minPoolSize := flag.Uint("min-pool-size", 1, "Minimum number of worker processes.")
-	maxPoolSize := flag.Uint("max-pool-size", 1, "Maximum number of worker processes.")
+	workerAttritionDelay := flag.Duration("worker-attrition-delay", defaults.WorkerAttritionDelay, "If no requests arrive in this period, a worker will be culled (down to the minimum pool size).")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Remove a worker that has handled no request for this long (down to the minimum pool size), 0 disables this.")
+	warmRestarts := flag.Bool("warm-restarts", false, "When restarting workers, wait for each replacement to start before restarting the next worker, starting an extra worker first if there is only one.")
+	fifoDispatch := flag.Bool("fifo-dispatch", false, "Hand requests to workers strictly in arrival order.")
+	rejectWhenPaused := flag.Bool("reject-when-paused", false, "Fail requests immediately while the pool is paused instead of waiting for it to resume.")
+	recycleOnInvalidResponse := flag.Bool("recycle-on-invalid-response", false, "Replace a worker after it sends a response that can't be sent, such as one without a status.")
+	failFastWithoutWorkers := flag.Bool("fail-fast-without-workers", false, "Fail requests immediately while every worker has crashed instead of waiting for one to come back.")
+	rejectUntilReady := flag.Bool("reject-until-ready", false, "Fail requests immediately until the first worker has started.")
+	minPoolSize := flag.Uint("min-pool-size", uint(defaults.MinWorkers), "Minimum number of worker processes.")
+	maxPoolSize := flag.Uint("max-pool-size", uint(defaults.MaxWorkers), "Maximum number of worker processes.")
 	requestBacklog := flag.Int("request-backlog", 1024, "Number of requests to accept in the backlog.")
+	maxQueuedRequests := flag.Int("max-queued-requests", 0, "Maximum number of requests waiting for or being handled by a worker, 0 means no limit.")
 	maxRequestBodySize := flag.Int("max-request-body-size", 4*1024*1024, "Maximum request size in bytes.")
+	maxResponseSize := flag.Uint32("max-response-size", defaults.WorkerMaxResponseSize, "Maximum worker response size in bytes, a worker sending a larger response is restarted. Responses held in memory are also limited to 32 MiB.")
+	pipeBufferSize := flag.Int("pipe-buffer-size", 0, "Size in bytes of the pipes to each worker (linux only), 0 keeps the system default.")
+	maxTotalRSS := flag.Int64("max-total-rss-bytes", 0, "Recycle the largest worker while all workers together use more memory than this (linux only), 0 means no limit.")
+	outlierLatencyFactor := flag.Float64("outlier-latency-factor", 0, "Recycle a worker whose average latency stays above this multiple of the pool median, 0 disables.")
+	outlierMinSamples := flag.Int("outlier-min-samples", 20, "Requests a worker must handle before its latency is compared with the other workers.")
+	latencyEMAAlpha := flag.Float64("latency-ema-alpha", defaults.LatencyEMAAlpha, "Weight of each request in the average latency reported by stats, between 0 and 1.")
+	lastErrorClearAfter := flag.Int("last-error-clear-after", 0, "Forget a worker's last error, as shown by the worker-stats ctl command, after this many successful requests, 0 keeps it.")
+	crashLogRequests := flag.Int("crash-log-requests", 0, "Log up to this many of the last requests a worker handled when it dies unexpectedly, 0 disables.")
+	warmupURIs := flag.StringSlice("warmup-uri", nil, "GET this uri from each new worker before it takes requests, may be repeated.")
+	watchPaths := flag.StringSlice("watch", nil, "Restart all workers when this file changes, may be repeated.")
+	watchDebounce := flag.Duration("watch-debounce", 2*time.Second, "Wait for watched files to stop changing for this long before restarting workers.")
+	normalizeHeaders := flag.Bool("normalize-headers", false, "Canonicalize response header names and drop duplicate header values.")
+	strictHeaders := flag.Bool("strict-headers", false, "With --normalize-headers, fail responses with conflicting values for headers that may only be sent once.")
+	fatalOutputPatterns := flag.StringSlice("fatal-output-pattern", nil, "Recycle a worker once it prints a line matching this regular expression, may be repeated.")
+	logHeaders := flag.StringSlice("log-header", nil, "Request header to add to every log line about a request, may be repeated.")
+	logRequestOnError := flag.Bool("log-request-on-error", false, "Log the full request when it fails, credential headers are redacted.")
+	logRequestMaxBodyBytes := flag.Int("log-request-max-body-bytes", 1024, "Maximum number of request body bytes to log with --log-request-on-error.")
+	idempotencyWindow := flag.Duration("idempotency-window", 0, "Serve repeated requests with the same Idempotency-Key header from the first response for this long, 0 disables.")
+	workerCoreDumps := flag.Bool("worker-core-dumps", false, "Let workers write core dumps when they crash and log where to find them (linux only), the location is set by /proc/sys/kernel/core_pattern.")
+	workerSetupProc := flag.String("worker-setup-proc", "", "Command to run once before starting any workers, e.g. to build a shared data file.")
 	listenOn := flag.String("listen-address", "127.0.0.1:8080", "Address to listen on.")
 	ctlSocket := flag.String("ctl-socket", "./poolparty.sock", "Control socket you can interact with using poolparty-ctl.")
 
 	flag.Parse()
 
+	setupProc, err := shlex.Split(*workerSetupProc, true)
+	if err != nil {
+		log("msg", "invalid worker setup command", "err", err)
+		os.Exit(1)
+	}
+
+	fatalPatterns := []*regexp.Regexp{}
+	for _, pattern := range *fatalOutputPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log("msg", "invalid fatal output pattern", "err", err)
+			os.Exit(1)
+		}
+		fatalPatterns = append(fatalPatterns, re)
+	}
+
 	cfg := poolparty.PoolConfig{
-		OnWorkerOutput:            rawlog,
-		WorkerSpawnTimeout:        *workerSpawnTimeout,
-		WorkerRendezvousTimeout:   *workerRendezvousTimeout,
-		WorkerRestartDelay:        *workerRestartDelay,
-		WorkerAttritionDelay:      *workerAttritionDelay,
-		WorkerRequestTimeout:      *workerRequestTimeout,
-		WorkerHealthCheckInterval: *workerHealthCheckInterval,
-		Logfn:                     log,
-		MinWorkers:                uint32(*minPoolSize),
-		MaxWorkers:                uint32(*maxPoolSize),
-		WorkerProc:                flag.Args(),
+		OnWorkerOutput: rawlog,
+		OnWorkerEvent: func(req poolparty.HTTPRequest, kind string, data []byte) {
+			log("msg", "worker event", "kind", kind, "data", data, "uri", req.Uri)
+		},
+		WorkerSpawnTimeout:          *workerSpawnTimeout,
+		WorkerRendezvousTimeout:     *workerRendezvousTimeout,
+		WorkerRestartDelay:          *workerRestartDelay,
+		MaxRestartsPerWindow:        *maxRestartsPerWindow,
+		RestartWindow:               *restartWindow,
+		StopRestartsOnTrip:          *stopRestartsOnTrip,
+		WorkerAttritionDelay:        *workerAttritionDelay,
+		IdleTimeout:                 *idleTimeout,
+		WorkerRequestTimeout:        *workerRequestTimeout,
+		WorkerWriteTimeout:          *workerWriteTimeout,
+		MaxRequestTimeout:           *maxRequestTimeout,
+		TotalTimeout:                *totalTimeout,
+		MaxWorkerCPUTime:            *maxWorkerCPUTime,
+		WorkerHealthCheckInterval:   *workerHealthCheckInterval,
+		WorkerHealthCheckJitter:     *workerHealthCheckJitter,
+		WorkerMaxResponseSize:       *maxResponseSize,
+		PipeBufferSize:              *pipeBufferSize,
+		MaxTotalRSSBytes:            *maxTotalRSS,
+		OutlierLatencyFactor:        *outlierLatencyFactor,
+		OutlierMinSamples:           *outlierMinSamples,
+		CrashLogRequests:            *crashLogRequests,
+		LastErrorClearAfter:         *lastErrorClearAfter,
+		LatencyEMAAlpha:             *latencyEMAAlpha,
+		RejectWhenPaused:            *rejectWhenPaused,
+		FIFODispatch:                *fifoDispatch,
+		WarmRestarts:                *warmRestarts,
+		RejectUntilReady:            *rejectUntilReady,
+		FailFastWithoutWorkers:      *failFastWithoutWorkers,
+		RecycleOnInvalidResponse:    *recycleOnInvalidResponse,
+		WorkerShutdownTimeout:       *workerShutdownTimeout,
+		RetireGrace:                 *retireGrace,
+		LameduckDuration:            *lameduckDuration,
+		WorkerHandshakeTimeout:      *workerHandshakeTimeout,
+		WorkerPrepareRecycleTimeout: *workerPrepareRecycleTimeout,
+		IdempotencyWindow:           *idempotencyWindow,
+		Logfn:                       log,
+		MinWorkers:                  uint32(*minPoolSize),
+		MaxWorkers:                  uint32(*maxPoolSize),
+		WorkerProc:                  flag.Args(),
+		WorkerSetupProc:             setupProc,
+		FatalOutputPatterns:         fatalPatterns,
+		WorkerCoreDumps:             *workerCoreDumps,
+		WatchPaths:                  *watchPaths,
+		WatchDebounce:               *watchDebounce,
+	}
+
+	for _, uri := range *warmupURIs {
+		cfg.WarmupRequests = append(cfg.WarmupRequests, poolparty.HTTPRequest{Method: "GET", Uri: uri})
+	}
+
+	if len(*logHeaders) != 0 {
+		cfg.LogFields = func(req poolparty.HTTPRequest) []interface{} {
+			fields := []interface{}{}
+			for _, hdr := range *logHeaders {
+				// fasthttp gives us canonical header names.
+				if v, ok := req.Headers[http.CanonicalHeaderKey(hdr)]; ok {
+					fields = append(fields, strings.ToLower(hdr), v)
+				}
+			}
+			return fields
+		}
+	}
+
+	if *maxQueuedRequests > 0 {
+		cfg.Admission = poolparty.NewBoundedQueueAdmission(*maxQueuedRequests)
 	}
 
 	pool, err := poolparty.NewWorkerPool(cfg)
@@ -91,11 +225,18 @@ func main() {
 	go textctl.Serve(ctlListener, &poolparty.CtlHandler{Pool: pool})
 
 	handler := poolparty.MakeHTTPHandler(pool, poolparty.HandlerConfig{
-		Logfn:           log,
-		StaticCompress:  *staticCompress,
-		StaticNoBrotli:  *staticNoBrotli,
-		StaticRoot:      *staticRoot,
-		StaticUrlPrefix: *staticUrlPrefix,
+		Logfn:                  log,
+		StaticCompress:         *staticCompress,
+		StaticNoBrotli:         *staticNoBrotli,
+		StaticRoot:             *staticRoot,
+		StaticUrlPrefix:        *staticUrlPrefix,
+		LogRequestOnError:      *logRequestOnError,
+		LogRequestMaxBodyBytes: *logRequestMaxBodyBytes,
+		RedactRequest:          redactRequest,
+		NormalizeHeaders:       *normalizeHeaders || *strictHeaders,
+		StrictHeaders:          *strictHeaders,
+		HealthCheckPath:        *healthCheckPath,
+		CompressResponses:      *compressResponses,
 	})
 
 	server := &fasthttp.Server{
@@ -118,6 +259,8 @@ func main() {
 		signal.Reset(os.Interrupt)
 		log("msg", "got shutdown signal, shutting down")
 		_ = ctlListener.Close()
+		// Keep serving while the health check fails.
+		pool.Lameduck(context.Background())
 		server.Shutdown()
 		close(gracefulShutdown)
 	}()
@@ -129,6 +272,22 @@ func main() {
 	}
 	<-gracefulShutdown
 	log("msg", "shutting down worker pool")
-	pool.Close()
-	log("msg", "graceful shutdown complete")
+	report := pool.Drain(context.Background(), func(progress poolparty.DrainProgress) {
+		log("msg", "draining worker pool", "in-flight", progress.InFlight, "workers", progress.Workers)
+	})
+	maxExitTime := time.Duration(0)
+	for _, t := range report.WorkerExitTimes {
+		if t > maxExitTime {
+			maxExitTime = t
+		}
+	}
+	log(
+		"msg", "graceful shutdown complete",
+		"in-flight-requests", report.InFlightRequests,
+		"drained-requests", report.DrainedRequests,
+		"abandoned-requests", report.AbandonedRequests,
+		"workers", len(report.WorkerExitTimes),
+		"killed-workers", report.KilledWorkers,
+		"max-worker-exit-time", maxExitTime,
+	)
 }
@@ -0,0 +1,56 @@
+package poolparty
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// enableCoreDumps raises a process's core file size limit as far as
+// its hard limit allows.
+func enableCoreDumps(pid int) error {
+	var limit syscall.Rlimit
+	err := prlimit(pid, syscall.RLIMIT_CORE, nil, &limit)
+	if err != nil {
+		return err
+	}
+	limit.Cur = limit.Max
+	return prlimit(pid, syscall.RLIMIT_CORE, &limit, nil)
+}
+
+func workerDumpedCore(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.CoreDump()
+}
+
+// corePath guesses where the kernel wrote the core of a process from
+// /proc/sys/kernel/core_pattern, only %p and %% are expanded.
+func corePath(pid int) string {
+	pattern, err := ioutil.ReadFile("/proc/sys/kernel/core_pattern")
+	if err != nil {
+		return "unknown"
+	}
+	path := strings.TrimSpace(string(pattern))
+	if strings.HasPrefix(path, "|") {
+		// e.g. systemd-coredump, the core can be found with its tools.
+		return "piped to " + strings.TrimPrefix(path, "|")
+	}
+	path = strings.NewReplacer("%p", strconv.Itoa(pid), "%%", "%").Replace(path)
+	if !filepath.IsAbs(path) {
+		// Relative to the worker's directory, which is ours.
+		wd, err := os.Getwd()
+		if err == nil {
+			path = filepath.Join(wd, path)
+		}
+	}
+	return path
+}
@@ -0,0 +1,16 @@
+// +build !linux
+
+package poolparty
+
+// Core dumps are best effort and not supported here.
+func enableCoreDumps(pid int) error {
+	return nil
+}
+
+func workerDumpedCore(err error) bool {
+	return false
+}
+
+func corePath(pid int) string {
+	return "unknown"
+}
@@ -0,0 +1,78 @@
+package poolparty
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Linux reports process times in USER_HZ ticks, which is 100 on every
+// architecture go supports.
+const clockTicksPerSecond = 100
+
+// workerCPUTime returns the user and system time a process has used.
+func workerCPUTime(pid int) (time.Duration, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces, so skip past it first.
+	end := strings.LastIndexByte(string(stat), ')')
+	if end == -1 {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat contents", pid)
+	}
+	// utime and stime are the 14th and 15th fields, the state after the
+	// command name is the 3rd.
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat contents", pid)
+	}
+	ticks := int64(0)
+	for _, field := range fields[11:13] {
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		ticks += n
+	}
+	return time.Duration(ticks) * time.Second / clockTicksPerSecond, nil
+}
+
+func prlimit(pid int, resource int, newLimit, oldLimit *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(
+		syscall.SYS_PRLIMIT64,
+		uintptr(pid),
+		uintptr(resource),
+		uintptr(unsafe.Pointer(newLimit)),
+		uintptr(unsafe.Pointer(oldLimit)),
+		0, 0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// limitCPUTime lets a process use at most budget more CPU time, rounded
+// up to a whole second, before the kernel sends it SIGXCPU. Only the soft
+// limit is changed so it can be raised again for the next request.
+func limitCPUTime(pid int, budget time.Duration) error {
+	used, err := workerCPUTime(pid)
+	if err != nil {
+		return err
+	}
+	var limit syscall.Rlimit
+	err = prlimit(pid, syscall.RLIMIT_CPU, nil, &limit)
+	if err != nil {
+		return err
+	}
+	limit.Cur = uint64((used + budget + time.Second - 1) / time.Second)
+	if limit.Cur > limit.Max {
+		limit.Cur = limit.Max
+	}
+	return prlimit(pid, syscall.RLIMIT_CPU, &limit, nil)
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package poolparty
+
+import (
+	"time"
+)
+
+// CPU limits are best effort and not supported here.
+func limitCPUTime(pid int, budget time.Duration) error {
+	return nil
+}
@@ -2,6 +2,9 @@
 #include <janet.h>
 #include <stdio.h>
 
+// Version of the poolparty <-> worker protocol, see README.md.
+#define PROTOCOL_VERSION 1
+
 static Janet out_fdopen(int32_t argc, Janet *argv) {
     janet_fixarity(argc, 1);
     const int fd = janet_getinteger(argv, 0);
@@ -18,6 +21,15 @@ static void put_varuint(JanetBuffer *buf, uint64_t x) {
   janet_buffer_push_u8(buf, (uint8_t)x);
 }
 
+// Fill in the size reserved at the start of a packet.
+static void put_packet_size(JanetBuffer *buf) {
+  int32_t rsz = buf->count - 4;
+  buf->data[0] = (rsz >> 0) & 0xff;
+  buf->data[1] = (rsz >> 8) & 0xff;
+  buf->data[2] = (rsz >> 16) & 0xff;
+  buf->data[3] = (rsz >> 24) & 0xff;
+}
+
 static uint64_t decode_varuint(uint8_t *buf, size_t sz, size_t *offset) {
   int i = 0;
   int s = 0;
@@ -105,6 +117,14 @@ static Janet read_request(int32_t argc, Janet *argv) {
       case 1:
         req = janet_ckeywordv("health-check");
         break;
+      case 2:
+        // The pool's protocol version, the pool checks ours in the reply.
+        decode_varuint(buf, sz, &offset);
+        req = janet_ckeywordv("handshake");
+        break;
+      case 3:
+        req = janet_ckeywordv("prepare-recycle");
+        break;
       default:
         janet_panicf("unknown or unsupported request variant - %d", variant);
     }
@@ -121,6 +141,7 @@ static Janet format_response(int32_t argc, Janet *argv) {
     Janet status = janet_get(req, janet_ckeywordv("status"));
     Janet headers = janet_get(req, janet_ckeywordv("headers"));
     Janet body = janet_get(req, janet_ckeywordv("body"));
+    Janet recycle = janet_get(req, janet_ckeywordv("recycle"));
 
     // Reserve enough for the size.
     janet_buffer_setcount(buf, 4);
@@ -196,11 +217,71 @@ static Janet format_response(int32_t argc, Janet *argv) {
       janet_panicf("response :body invalid, got %v", body);
     }
 
-    int32_t rsz = buf->count - 4;
-    buf->data[0] = (rsz >> 0) & 0xff;
-    buf->data[1] = (rsz >> 8) & 0xff;
-    buf->data[2] = (rsz >> 16) & 0xff;
-    buf->data[3] = (rsz >> 24) & 0xff;
+    janet_buffer_push_u8(buf, janet_truthy(recycle) ? 1 : 0);
+
+    put_packet_size(buf);
+    return janet_wrap_buffer(buf);
+}
+
+static Janet format_error_response(int32_t argc, Janet *argv) {
+    janet_fixarity(argc, 2);
+    JanetByteView msg = janet_getbytes(argv, 0);
+    JanetBuffer *buf = janet_getbuffer(argv, 1);
+
+    // Reserve enough for the size.
+    janet_buffer_setcount(buf, 4);
+
+    put_varuint(buf, 1);
+    put_varuint(buf, msg.len);
+    janet_buffer_push_bytes(buf, msg.bytes, msg.len);
+
+    put_packet_size(buf);
+    return janet_wrap_buffer(buf);
+}
+
+static Janet format_handshake_response(int32_t argc, Janet *argv) {
+    janet_fixarity(argc, 1);
+    JanetBuffer *buf = janet_getbuffer(argv, 0);
+
+    // Reserve enough for the size.
+    janet_buffer_setcount(buf, 4);
+
+    put_varuint(buf, 2);
+    put_varuint(buf, PROTOCOL_VERSION);
+
+    put_packet_size(buf);
+    return janet_wrap_buffer(buf);
+}
+
+static Janet format_prepare_recycle_response(int32_t argc, Janet *argv) {
+    janet_fixarity(argc, 1);
+    JanetBuffer *buf = janet_getbuffer(argv, 0);
+
+    // Reserve enough for the size.
+    janet_buffer_setcount(buf, 4);
+
+    put_varuint(buf, 4);
+
+    put_packet_size(buf);
+    return janet_wrap_buffer(buf);
+}
+
+static Janet format_event(int32_t argc, Janet *argv) {
+    janet_fixarity(argc, 3);
+    JanetByteView kind = janet_getbytes(argv, 0);
+    JanetByteView data = janet_getbytes(argv, 1);
+    JanetBuffer *buf = janet_getbuffer(argv, 2);
+
+    // Reserve enough for the size.
+    janet_buffer_setcount(buf, 4);
+
+    put_varuint(buf, 3);
+    put_varuint(buf, kind.len);
+    janet_buffer_push_bytes(buf, kind.bytes, kind.len);
+    put_varuint(buf, data.len);
+    janet_buffer_push_bytes(buf, data.bytes, data.len);
+
+    put_packet_size(buf);
     return janet_wrap_buffer(buf);
 }
 
@@ -208,6 +289,10 @@ static const JanetReg cfuns[] = {
     {"out-fdopen", out_fdopen, NULL},
     {"read-request", read_request, NULL},
     {"format-response", format_response, NULL},
+    {"format-error-response", format_error_response, NULL},
+    {"format-handshake-response", format_handshake_response, NULL},
+    {"format-prepare-recycle-response", format_prepare_recycle_response, NULL},
+    {"format-event", format_event, NULL},
     {NULL, NULL, NULL}};
 
 JANET_MODULE_ENTRY(JanetTable *env) { janet_cfuns(env, "_poolparty", cfuns); }
@@ -9,6 +9,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -24,6 +25,31 @@ func (h *CtlHandler) Handle(cmd string, args []string, w io.Writer) error {
 			return errors.New("unexpected arguments")
 		}
 		return h.Pool.RestartWorkers(context.Background())
+	case "cancel-requests":
+		if len(args) != 1 {
+			return errors.New("expected a uri substring")
+		}
+		n := h.Pool.CancelWhere(func(info RequestInfo) bool {
+			return strings.Contains(info.Uri, args[0])
+		})
+		_, err := fmt.Fprintf(w, "cancelled=%d\n", n)
+		return err
+	case "reset-restart-guard":
+		if len(args) != 0 {
+			return errors.New("unexpected arguments")
+		}
+		h.Pool.ResetRestartGuard()
+		return nil
+	case "pause", "resume":
+		if len(args) != 0 {
+			return errors.New("unexpected arguments")
+		}
+		if cmd == "pause" {
+			h.Pool.Pause()
+		} else {
+			h.Pool.Resume()
+		}
+		return nil
 	case "spawn-workers", "remove-workers":
 		if len(args) != 1 {
 			return errors.New("expected a single argument")
@@ -41,6 +67,24 @@ func (h *CtlHandler) Handle(cmd string, args []string, w io.Writer) error {
 			}
 		}
 		return nil
+	case "quiesce-worker":
+		if len(args) != 2 {
+			return errors.New("expected a worker id and a duration")
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		d, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		pid, _, err := h.Pool.QuiesceWorker(context.Background(), id, d)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "pid=%d\n", pid)
+		return err
 	case "stats":
 		if len(args) != 0 {
 			return errors.New("unexpected arguments")
@@ -50,6 +94,40 @@ func (h *CtlHandler) Handle(cmd string, args []string, w io.Writer) error {
 		_, _ = fmt.Fprintf(&buf, "goroutines=%d\n", runtime.NumGoroutine())
 		_, _ = fmt.Fprintf(&buf, "workers=%d\n", stats.Workers)
 		_, _ = fmt.Fprintf(&buf, "worker-restarts=%d\n", stats.WorkerRestarts)
+		_, _ = fmt.Fprintf(&buf, "paused=%t\n", stats.Paused)
+		_, _ = fmt.Fprintf(&buf, "requests=%d\n", stats.Requests)
+		_, _ = fmt.Fprintf(&buf, "rate-limited=%d\n", stats.RateLimited)
+		_, _ = fmt.Fprintf(&buf, "request-bytes=%d\n", stats.RequestSizes.Bytes)
+		_, _ = fmt.Fprintf(&buf, "response-bytes=%d\n", stats.ResponseSizes.Bytes)
+		_, _ = fmt.Fprintf(&buf, "total-rss-bytes=%d\n", stats.TotalRSSBytes)
+		_, _ = fmt.Fprintf(&buf, "avg-latency-ema=%s\n", stats.AvgLatencyEMA)
+		_, _ = fmt.Fprintf(&buf, "idle-reaped=%d\n", stats.IdleReaped)
+		_, _ = fmt.Fprintf(&buf, "spawn-duration-min=%s\n", stats.SpawnDurations.Min)
+		_, _ = fmt.Fprintf(&buf, "spawn-duration-max=%s\n", stats.SpawnDurations.Max)
+		_, _ = fmt.Fprintf(&buf, "spawn-duration-avg=%s\n", stats.SpawnDurations.Avg)
+		_, _ = fmt.Fprintf(&buf, "warmup-duration-min=%s\n", stats.WarmupDurations.Min)
+		_, _ = fmt.Fprintf(&buf, "warmup-duration-max=%s\n", stats.WarmupDurations.Max)
+		_, _ = fmt.Fprintf(&buf, "warmup-duration-avg=%s\n", stats.WarmupDurations.Avg)
+		_, _ = fmt.Fprintf(&buf, "restart-guard-tripped=%t\n", stats.RestartGuardTripped)
+		for i, n := range stats.ResponseSizes.Buckets {
+			if n != 0 {
+				_, _ = fmt.Fprintf(&buf, "responses-under-%d-bytes=%d\n", uint64(1)<<i, n)
+			}
+		}
+		_, err := w.Write(buf.Bytes())
+		return err
+	case "worker-stats":
+		if len(args) != 0 {
+			return errors.New("unexpected arguments")
+		}
+		buf := bytes.Buffer{}
+		for _, stats := range h.Pool.WorkerStats() {
+			_, _ = fmt.Fprintf(&buf, "id=%d pid=%d requests=%d", stats.ID, stats.Pid, stats.Requests)
+			if stats.LastError != "" {
+				_, _ = fmt.Fprintf(&buf, " last-error-time=%s last-error=%q", stats.LastErrorTime.Format(time.RFC3339), stats.LastError)
+			}
+			buf.WriteByte('\n')
+		}
 		_, err := w.Write(buf.Bytes())
 		return err
 	case "collectd-metrics":
@@ -85,6 +163,14 @@ func (h *CtlHandler) Handle(cmd string, args []string, w io.Writer) error {
 			fmt.Fprintf(bufw, "putval %s/poolparty%s/gauge-goroutines interval=%d %d:%d\n", host, metricsLabelSuffix, metricsInterval, now, runtime.NumGoroutine())
 			fmt.Fprintf(bufw, "putval %s/poolparty%s/gauge-workers interval=%d %d:%d\n", host, metricsLabelSuffix, metricsInterval, now, stats.Workers)
 			fmt.Fprintf(bufw, "putval %s/poolparty%s/counter-worker-restarts interval=%d %d:%d\n", host, metricsLabelSuffix, metricsInterval, now, stats.WorkerRestarts)
+			fmt.Fprintf(bufw, "putval %s/poolparty%s/counter-requests interval=%d %d:%d\n", host, metricsLabelSuffix, metricsInterval, now, stats.Requests)
+			fmt.Fprintf(bufw, "putval %s/poolparty%s/counter-rate-limited interval=%d %d:%d\n", host, metricsLabelSuffix, metricsInterval, now, stats.RateLimited)
+			fmt.Fprintf(bufw, "putval %s/poolparty%s/counter-request-bytes interval=%d %d:%d\n", host, metricsLabelSuffix, metricsInterval, now, stats.RequestSizes.Bytes)
+			fmt.Fprintf(bufw, "putval %s/poolparty%s/counter-response-bytes interval=%d %d:%d\n", host, metricsLabelSuffix, metricsInterval, now, stats.ResponseSizes.Bytes)
+			fmt.Fprintf(bufw, "putval %s/poolparty%s/gauge-avg-latency-ema-seconds interval=%d %d:%f\n", host, metricsLabelSuffix, metricsInterval, now, stats.AvgLatencyEMA.Seconds())
+			fmt.Fprintf(bufw, "putval %s/poolparty%s/counter-idle-reaped interval=%d %d:%d\n", host, metricsLabelSuffix, metricsInterval, now, stats.IdleReaped)
+			fmt.Fprintf(bufw, "putval %s/poolparty%s/gauge-avg-spawn-duration-seconds interval=%d %d:%f\n", host, metricsLabelSuffix, metricsInterval, now, stats.SpawnDurations.Avg.Seconds())
+			fmt.Fprintf(bufw, "putval %s/poolparty%s/gauge-avg-warmup-duration-seconds interval=%d %d:%f\n", host, metricsLabelSuffix, metricsInterval, now, stats.WarmupDurations.Avg.Seconds())
 			_, err := w.Write(buf.Bytes())
 			if err != nil {
 				return err
@@ -92,5 +178,5 @@ func (h *CtlHandler) Handle(cmd string, args []string, w io.Writer) error {
 			time.Sleep(time.Duration(metricsInterval) * time.Second)
 		}
 	}
-	return errors.New("unknown command, want restart-workers|spawn-workers|remove-workers|stats|collectd-metrics")
+	return errors.New("unknown command, want restart-workers|reset-restart-guard|cancel-requests|pause|resume|spawn-workers|remove-workers|quiesce-worker|stats|worker-stats|collectd-metrics")
 }
@@ -0,0 +1,29 @@
+package poolparty
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// DebugHandler serves a read only JSON view of the pool's state, meant
+// to be mounted somewhere like /debug/poolparty on an internal server.
+func DebugHandler(p *WorkerPool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(struct {
+			Stats    WorkerPoolStats
+			InFlight int64
+			Workers  []WorkerStats
+		}{
+			Stats:    p.Stats(),
+			InFlight: p.InFlight(),
+			Workers:  p.WorkerStats(),
+		})
+	})
+}
@@ -0,0 +1,95 @@
+package poolparty
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// DrainProgress is passed to the Drain progress callback.
+type DrainProgress struct {
+	// Requests still waiting for or being handled by a worker.
+	InFlight int64
+	// Workers that have not exited yet.
+	Workers int
+}
+
+// Lameduck makes Healthy report false for LameduckDuration while the
+// pool keeps serving requests, giving load balancers time to stop
+// sending traffic before Drain starts rejecting it. Only the first call
+// waits, later calls and calls without a LameduckDuration return
+// immediately.
+func (p *WorkerPool) Lameduck(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&p.lameduck, 0, 1) || p.cfg.LameduckDuration <= 0 {
+		return
+	}
+	p.log("msg", "entering lameduck", "duration", p.cfg.LameduckDuration)
+	t := time.NewTimer(p.cfg.LameduckDuration)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// Healthy reports whether the pool wants traffic, it is false until the
+// first worker has started and once Lameduck or Drain is called.
+func (p *WorkerPool) Healthy() bool {
+	return atomic.LoadInt32(&p.ready) != 0 &&
+		atomic.LoadInt32(&p.lameduck) == 0 &&
+		atomic.LoadInt32(&p.draining) == 0
+}
+
+// Drain calls Lameduck, then stops the pool accepting requests, new
+// requests fail with ErrWorkerPoolClosed, waits for requests already
+// dispatched to finish and closes the pool like Close. If ctx is done
+// first, the remaining requests are abandoned.
+//
+// If progress is not nil, it is called once the lameduck period is over,
+// as each request finishes and as each worker exits.
+func (p *WorkerPool) Drain(ctx context.Context, progress func(DrainProgress)) ShutdownReport {
+	p.Lameduck(ctx)
+	atomic.StoreInt32(&p.draining, 1)
+	p.beginShutdown()
+
+	report := func() {
+		if progress != nil {
+			progress(DrainProgress{
+				InFlight: atomic.LoadInt64(&p.inFlight),
+				Workers:  int(atomic.LoadInt32(&p.runningWorkers)),
+			})
+		}
+	}
+
+	report()
+	for atomic.LoadInt64(&p.inFlight) != 0 {
+		select {
+		case <-ctx.Done():
+			return p.Close()
+		case <-p.drainNotify:
+			report()
+		}
+	}
+
+	closed := make(chan ShutdownReport, 1)
+	go func() {
+		closed <- p.Close()
+	}()
+	for {
+		select {
+		case shutdownReport := <-closed:
+			return shutdownReport
+		case <-p.drainNotify:
+			report()
+		}
+	}
+}
+
+func (p *WorkerPool) notifyDrain() {
+	if atomic.LoadInt32(&p.draining) != 0 {
+		select {
+		case p.drainNotify <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package poolparty
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/anmitsu/go-shlex"
+)
+
+// DefaultPoolConfig returns the configuration used by the poolparty
+// command when no flags are given.
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		MinWorkers:                1,
+		MaxWorkers:                1,
+		WorkerSpawnTimeout:        50 * time.Millisecond,
+		WorkerRendezvousTimeout:   60 * time.Second,
+		WorkerRequestTimeout:      60 * time.Second,
+		WorkerRestartDelay:        1 * time.Second,
+		WorkerAttritionDelay:      120 * time.Second,
+		WorkerHealthCheckInterval: 120 * time.Second,
+		WorkerHealthCheckJitter:   0.1,
+		WorkerShutdownTimeout:     10 * time.Second,
+		WorkerMaxResponseSize:     maxWorkerResponseSize,
+		LatencyEMAAlpha:           0.1,
+	}
+}
+
+// NewWorkerPoolFromEnv creates a worker pool configured from environment
+// variables starting with prefix, any variable that is not set keeps
+// its value from DefaultPoolConfig. With the prefix "POOLPARTY_" the
+// recognized variables are:
+//
+//	POOLPARTY_WORKER_PROC                     Worker command, split like a shell would.
+//	POOLPARTY_WORKER_SETUP_PROC               Command run once before starting workers.
+//	POOLPARTY_WORKER_CORE_DUMPS               true or false, default false, linux only.
+//	POOLPARTY_MIN_WORKERS                     Default 1.
+//	POOLPARTY_MAX_WORKERS                     Default 1.
+//	POOLPARTY_WORKER_SPAWN_TIMEOUT            Default 50ms.
+//	POOLPARTY_WORKER_RENDEZVOUS_TIMEOUT       Default 60s.
+//	POOLPARTY_WORKER_REQUEST_TIMEOUT          Default 60s.
+//	POOLPARTY_MAX_REQUEST_TIMEOUT             Default 0, no limit.
+//	POOLPARTY_WORKER_WRITE_TIMEOUT            Default 0, disabled.
+//	POOLPARTY_TOTAL_TIMEOUT                   Default 0, disabled.
+//	POOLPARTY_MAX_WORKER_CPU_TIME             Default 0, disabled, linux only.
+//	POOLPARTY_WORKER_RESTART_DELAY            Default 1s.
+//	POOLPARTY_MAX_RESTARTS_PER_WINDOW         Default 0, disabled.
+//	POOLPARTY_RESTART_WINDOW                  Default 1m.
+//	POOLPARTY_STOP_RESTARTS_ON_TRIP           true or false, default false.
+//	POOLPARTY_WORKER_ATTRITION_DELAY          Default 2m.
+//	POOLPARTY_IDLE_TIMEOUT                    Default 0, disabled.
+//	POOLPARTY_WORKER_HEALTH_CHECK_INTERVAL    Default 2m.
+//	POOLPARTY_WORKER_HEALTH_CHECK_JITTER      Default 0.1.
+//	POOLPARTY_LAMEDUCK_DURATION               Default 0, disabled.
+//	POOLPARTY_WORKER_SHUTDOWN_TIMEOUT         Default 10s.
+//	POOLPARTY_RETIRE_GRACE                    Default 0, disabled.
+//	POOLPARTY_WORKER_HANDSHAKE_TIMEOUT        Default 0, the request timeout.
+//	POOLPARTY_WORKER_PREPARE_RECYCLE_TIMEOUT  Default 0, disabled.
+//	POOLPARTY_WORKER_MAX_RESPONSE_SIZE        In bytes, default 32MiB.
+//	POOLPARTY_REQUEST_LOG_LIMIT               In bytes, default 64KiB.
+//	POOLPARTY_SPILL_THRESHOLD                 In bytes, default 0, disabled.
+//	POOLPARTY_SPILL_DIR                       Directory for spilled responses, default the temp dir.
+//	POOLPARTY_IDEMPOTENCY_WINDOW              Default 0, disabled.
+//	POOLPARTY_FIFO_DISPATCH                   true or false, default false.
+//	POOLPARTY_WARM_RESTARTS                   true or false, default false.
+//	POOLPARTY_PIPE_BUFFER_SIZE                In bytes, default 0, the system default, linux only.
+//	POOLPARTY_MAX_TOTAL_RSS_BYTES             In bytes, default 0, disabled, linux only.
+//	POOLPARTY_OUTLIER_LATENCY_FACTOR          Default 0, disabled.
+//	POOLPARTY_OUTLIER_MIN_SAMPLES             Default 20.
+//	POOLPARTY_CRASH_LOG_REQUESTS              Default 0, disabled.
+//	POOLPARTY_LAST_ERROR_CLEAR_AFTER          Default 0, never cleared.
+//	POOLPARTY_LATENCY_EMA_ALPHA               Default 0.1.
+//	POOLPARTY_REJECT_WHEN_PAUSED              true or false, default false.
+//	POOLPARTY_REJECT_UNTIL_READY              true or false, default false.
+//	POOLPARTY_FAIL_FAST_WITHOUT_WORKERS       true or false, default false.
+//	POOLPARTY_RECYCLE_ON_INVALID_RESPONSE     true or false, default false.
+func NewWorkerPoolFromEnv(prefix string) (*WorkerPool, error) {
+	cfg, err := PoolConfigFromEnv(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return NewWorkerPool(cfg)
+}
+
+// PoolConfigFromEnv reads the configuration used by NewWorkerPoolFromEnv.
+func PoolConfigFromEnv(prefix string) (PoolConfig, error) {
+	cfg := DefaultPoolConfig()
+
+	lookup := func(name string) (string, string, bool) {
+		name = prefix + name
+		v, ok := os.LookupEnv(name)
+		return name, v, ok
+	}
+
+	envUint32 := func(name string, dest *uint32) error {
+		name, v, ok := lookup(name)
+		if !ok {
+			return nil
+		}
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", name, v)
+		}
+		*dest = uint32(n)
+		return nil
+	}
+
+	envInt := func(name string, dest *int) error {
+		name, v, ok := lookup(name)
+		if !ok {
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", name, v)
+		}
+		*dest = n
+		return nil
+	}
+
+	envDuration := func(name string, dest *time.Duration) error {
+		name, v, ok := lookup(name)
+		if !ok {
+			return nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 10s, got %q", name, v)
+		}
+		*dest = d
+		return nil
+	}
+
+	envInt64 := func(name string, dest *int64) error {
+		name, v, ok := lookup(name)
+		if !ok {
+			return nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", name, v)
+		}
+		*dest = n
+		return nil
+	}
+
+	envFloat := func(name string, dest *float64) error {
+		name, v, ok := lookup(name)
+		if !ok {
+			return nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", name, v)
+		}
+		*dest = f
+		return nil
+	}
+
+	envBool := func(name string, dest *bool) error {
+		name, v, ok := lookup(name)
+		if !ok {
+			return nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, got %q", name, v)
+		}
+		*dest = b
+		return nil
+	}
+
+	envString := func(name string, dest *string) error {
+		_, v, ok := lookup(name)
+		if ok {
+			*dest = v
+		}
+		return nil
+	}
+
+	envCommand := func(name string, dest *[]string) error {
+		name, v, ok := lookup(name)
+		if !ok {
+			return nil
+		}
+		proc, err := shlex.Split(v, true)
+		if err != nil {
+			return fmt.Errorf("%s is not a valid command: %w", name, err)
+		}
+		*dest = proc
+		return nil
+	}
+
+	for _, err := range []error{
+		envCommand("WORKER_PROC", &cfg.WorkerProc),
+		envCommand("WORKER_SETUP_PROC", &cfg.WorkerSetupProc),
+		envBool("WORKER_CORE_DUMPS", &cfg.WorkerCoreDumps),
+		envUint32("MIN_WORKERS", &cfg.MinWorkers),
+		envUint32("MAX_WORKERS", &cfg.MaxWorkers),
+		envDuration("WORKER_SPAWN_TIMEOUT", &cfg.WorkerSpawnTimeout),
+		envDuration("WORKER_RENDEZVOUS_TIMEOUT", &cfg.WorkerRendezvousTimeout),
+		envDuration("WORKER_REQUEST_TIMEOUT", &cfg.WorkerRequestTimeout),
+		envDuration("MAX_REQUEST_TIMEOUT", &cfg.MaxRequestTimeout),
+		envDuration("WORKER_WRITE_TIMEOUT", &cfg.WorkerWriteTimeout),
+		envDuration("TOTAL_TIMEOUT", &cfg.TotalTimeout),
+		envDuration("MAX_WORKER_CPU_TIME", &cfg.MaxWorkerCPUTime),
+		envDuration("WORKER_RESTART_DELAY", &cfg.WorkerRestartDelay),
+		envInt("MAX_RESTARTS_PER_WINDOW", &cfg.MaxRestartsPerWindow),
+		envDuration("RESTART_WINDOW", &cfg.RestartWindow),
+		envBool("STOP_RESTARTS_ON_TRIP", &cfg.StopRestartsOnTrip),
+		envDuration("WORKER_ATTRITION_DELAY", &cfg.WorkerAttritionDelay),
+		envDuration("IDLE_TIMEOUT", &cfg.IdleTimeout),
+		envDuration("WORKER_HEALTH_CHECK_INTERVAL", &cfg.WorkerHealthCheckInterval),
+		envFloat("WORKER_HEALTH_CHECK_JITTER", &cfg.WorkerHealthCheckJitter),
+		envDuration("LAMEDUCK_DURATION", &cfg.LameduckDuration),
+		envDuration("WORKER_SHUTDOWN_TIMEOUT", &cfg.WorkerShutdownTimeout),
+		envDuration("RETIRE_GRACE", &cfg.RetireGrace),
+		envDuration("WORKER_HANDSHAKE_TIMEOUT", &cfg.WorkerHandshakeTimeout),
+		envDuration("WORKER_PREPARE_RECYCLE_TIMEOUT", &cfg.WorkerPrepareRecycleTimeout),
+		envUint32("WORKER_MAX_RESPONSE_SIZE", &cfg.WorkerMaxResponseSize),
+		envInt("REQUEST_LOG_LIMIT", &cfg.RequestLogLimit),
+		envInt64("SPILL_THRESHOLD", &cfg.SpillThreshold),
+		envString("SPILL_DIR", &cfg.SpillDir),
+		envDuration("IDEMPOTENCY_WINDOW", &cfg.IdempotencyWindow),
+		envInt("PIPE_BUFFER_SIZE", &cfg.PipeBufferSize),
+		envInt64("MAX_TOTAL_RSS_BYTES", &cfg.MaxTotalRSSBytes),
+		envFloat("OUTLIER_LATENCY_FACTOR", &cfg.OutlierLatencyFactor),
+		envInt("OUTLIER_MIN_SAMPLES", &cfg.OutlierMinSamples),
+		envInt("CRASH_LOG_REQUESTS", &cfg.CrashLogRequests),
+		envInt("LAST_ERROR_CLEAR_AFTER", &cfg.LastErrorClearAfter),
+		envFloat("LATENCY_EMA_ALPHA", &cfg.LatencyEMAAlpha),
+		envBool("FIFO_DISPATCH", &cfg.FIFODispatch),
+		envBool("WARM_RESTARTS", &cfg.WarmRestarts),
+		envBool("REJECT_WHEN_PAUSED", &cfg.RejectWhenPaused),
+		envBool("REJECT_UNTIL_READY", &cfg.RejectUntilReady),
+		envBool("FAIL_FAST_WITHOUT_WORKERS", &cfg.FailFastWithoutWorkers),
+		envBool("RECYCLE_ON_INVALID_RESPONSE", &cfg.RecycleOnInvalidResponse),
+	} {
+		if err != nil {
+			return PoolConfig{}, err
+		}
+	}
+
+	return cfg, nil
+}
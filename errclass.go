@@ -0,0 +1,98 @@
+package poolparty
+
+import (
+	"errors"
+)
+
+// A Class is a broad reason a request failed, see ErrorClass.
+type Class int
+
+const (
+	ClassNone Class = iota
+	ClassClosed
+	ClassBusy
+	ClassPaused
+	ClassNotReady
+	ClassRateLimited
+	ClassTimeout
+	ClassHandlerError
+	ClassWorkerDied
+	ClassInvalidRequest
+	ClassCancelled
+)
+
+func (c Class) String() string {
+	switch c {
+	case ClassNone:
+		return "none"
+	case ClassClosed:
+		return "closed"
+	case ClassBusy:
+		return "busy"
+	case ClassPaused:
+		return "paused"
+	case ClassNotReady:
+		return "not-ready"
+	case ClassRateLimited:
+		return "rate-limited"
+	case ClassTimeout:
+		return "timeout"
+	case ClassHandlerError:
+		return "handler-error"
+	case ClassWorkerDied:
+		return "worker-died"
+	case ClassInvalidRequest:
+		return "invalid-request"
+	case ClassCancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrorClass maps an error returned by Dispatch to its Class:
+//
+//	nil                  ClassNone
+//	ErrWorkerPoolClosed  ClassClosed, the pool was closed.
+//	ErrWorkerPoolBusy    ClassBusy, no worker took the request in time or the admission controller refused it.
+//	ErrQueueTimeout      ClassBusy, TotalTimeout expired before a worker took the request.
+//	ErrWorkerPoolPaused  ClassPaused
+//	ErrPoolNotReady      ClassNotReady
+//	ErrRateLimited       ClassRateLimited
+//	ErrWorkerTimeout     ClassTimeout, the worker exceeded WorkerRequestTimeout and was restarted.
+//	ErrExecTimeout       ClassTimeout, TotalTimeout expired while a worker handled the request.
+//	ErrNoHealthyWorkers  ClassWorkerDied, every worker has crashed or failed to start.
+//	*HandlerError        ClassHandlerError, the worker's handler raised an error.
+//	ErrInvalidResponse   ClassHandlerError, the worker's handler returned a response that can't be sent.
+//	ErrInvalidRequest    ClassInvalidRequest, RequestValidator rejected the request.
+//	ErrRequestCancelled  ClassCancelled, CancelWhere cancelled the request.
+//
+// Any other error means the worker died or broke the protocol while
+// handling the request and is ClassWorkerDied.
+func ErrorClass(err error) Class {
+	var handlerErr *HandlerError
+	switch {
+	case err == nil:
+		return ClassNone
+	case errors.Is(err, ErrWorkerPoolClosed):
+		return ClassClosed
+	case errors.Is(err, ErrWorkerPoolBusy), errors.Is(err, ErrQueueTimeout):
+		return ClassBusy
+	case errors.Is(err, ErrWorkerPoolPaused):
+		return ClassPaused
+	case errors.Is(err, ErrPoolNotReady):
+		return ClassNotReady
+	case errors.Is(err, ErrRateLimited):
+		return ClassRateLimited
+	case errors.Is(err, ErrWorkerTimeout), errors.Is(err, ErrExecTimeout):
+		return ClassTimeout
+	case errors.As(err, &handlerErr), errors.Is(err, ErrInvalidResponse):
+		return ClassHandlerError
+	case errors.Is(err, ErrInvalidRequest):
+		return ClassInvalidRequest
+	case errors.Is(err, ErrRequestCancelled):
+		return ClassCancelled
+	default:
+		return ClassWorkerDied
+	}
+}
@@ -0,0 +1,40 @@
+package poolparty
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorClass(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		class Class
+	}{
+		{nil, ClassNone},
+		{ErrWorkerPoolClosed, ClassClosed},
+		{ErrWorkerPoolBusy, ClassBusy},
+		{fmt.Errorf("%w: another DispatchToWorker is in progress", ErrWorkerPoolBusy), ClassBusy},
+		{ErrQueueTimeout, ClassBusy},
+		{ErrWorkerPoolPaused, ClassPaused},
+		{ErrPoolNotReady, ClassNotReady},
+		{ErrRateLimited, ClassRateLimited},
+		{ErrWorkerTimeout, ClassTimeout},
+		{fmt.Errorf("request failed: %w", fmt.Errorf("%w after writing the request", ErrWorkerTimeout)), ClassTimeout},
+		{ErrExecTimeout, ClassTimeout},
+		{ErrNoHealthyWorkers, ClassWorkerDied},
+		{&HandlerError{Msg: "boom"}, ClassHandlerError},
+		{fmt.Errorf("request failed: %w", &HandlerError{Msg: "boom"}), ClassHandlerError},
+		{ErrInvalidResponse, ClassHandlerError},
+		{fmt.Errorf("request failed: %w: status 0", ErrInvalidResponse), ClassHandlerError},
+		{ErrInvalidRequest, ClassInvalidRequest},
+		{fmt.Errorf("%w: bad uri", ErrInvalidRequest), ClassInvalidRequest},
+		{ErrRequestCancelled, ClassCancelled},
+		{fmt.Errorf("request failed: %w", ErrRequestCancelled), ClassCancelled},
+		{errors.New("unable to worker read response length: EOF"), ClassWorkerDied},
+	} {
+		if class := ErrorClass(tc.err); class != tc.class {
+			t.Errorf("ErrorClass(%v) = %s, want %s", tc.err, class, tc.class)
+		}
+	}
+}
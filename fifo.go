@@ -0,0 +1,61 @@
+package poolparty
+
+import (
+	"sync"
+)
+
+// fifoQueue hands out turns in the order enter was called, one turn at
+// a time.
+type fifoQueue struct {
+	mu      sync.Mutex
+	running bool
+	waiting []*fifoWaiter
+}
+
+type fifoWaiter struct {
+	// Closed when it is this waiter's turn.
+	ready chan struct{}
+	left  bool
+}
+
+func (q *fifoQueue) enter() *fifoWaiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w := &fifoWaiter{ready: make(chan struct{})}
+	if !q.running {
+		q.running = true
+		close(w.ready)
+	} else {
+		q.waiting = append(q.waiting, w)
+	}
+	return w
+}
+
+// leave ends w's turn, or gives up its place if its turn has not come
+// yet. Calling leave more than once does nothing.
+func (q *fifoQueue) leave(w *fifoWaiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.left {
+		return
+	}
+	w.left = true
+
+	select {
+	case <-w.ready:
+		if len(q.waiting) == 0 {
+			q.running = false
+			return
+		}
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		close(next.ready)
+	default:
+		for i, waiter := range q.waiting {
+			if waiter == w {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+}
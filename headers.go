@@ -0,0 +1,67 @@
+package poolparty
+
+import (
+	"fmt"
+	"net/textproto"
+	"sort"
+)
+
+// Headers that may appear at most once in a response.
+var singletonHeaders = map[string]bool{
+	"Content-Length":   true,
+	"Content-Type":     true,
+	"Content-Encoding": true,
+	"Location":         true,
+	"Date":             true,
+	"Etag":             true,
+	"Last-Modified":    true,
+	"Expires":          true,
+	"Server":           true,
+}
+
+// NormalizeHeaders canonicalizes the casing of response header names,
+// merging names that differ only by case, and drops repeated identical
+// values. Set-Cookie values are always kept as they are, since each is a
+// separate cookie. Headers that may only appear once, like
+// Content-Length, keep their first value, or are an error in strict mode
+// when their values conflict.
+func NormalizeHeaders(headers map[string][]string, strict bool) (map[string][]string, error) {
+	// Merge in a fixed order so the first value is the same every time.
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	normalized := make(map[string][]string, len(headers))
+	for _, name := range names {
+		canonical := textproto.CanonicalMIMEHeaderKey(name)
+		normalized[canonical] = append(normalized[canonical], headers[name]...)
+	}
+
+	for name, values := range normalized {
+		if name == "Set-Cookie" || len(values) < 2 {
+			continue
+		}
+		if singletonHeaders[name] {
+			for _, v := range values[1:] {
+				if v != values[0] && strict {
+					return nil, fmt.Errorf("conflicting values for response header %s: %q and %q", name, values[0], v)
+				}
+			}
+			normalized[name] = values[:1]
+			continue
+		}
+		seen := make(map[string]bool, len(values))
+		unique := values[:0]
+		for _, v := range values {
+			if !seen[v] {
+				seen[v] = true
+				unique = append(unique, v)
+			}
+		}
+		normalized[name] = unique
+	}
+
+	return normalized, nil
+}
@@ -0,0 +1,159 @@
+package poolparty
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestNormalizeHeaders(t *testing.T) {
+	longName := "X-Long" + strings.Repeat("n", 4096)
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		strict  bool
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name:    "case folding",
+			headers: map[string][]string{"x-foo": {"a"}, "X-FOO": {"b"}},
+			want:    map[string][]string{"X-Foo": {"b", "a"}},
+		},
+		{
+			name:    "repeated values",
+			headers: map[string][]string{"X-Foo": {"a", "b", "a", "b"}},
+			want:    map[string][]string{"X-Foo": {"a", "b"}},
+		},
+		{
+			name:    "empty values",
+			headers: map[string][]string{"X-Empty": {""}, "X-Mixed": {"", "a", ""}},
+			want:    map[string][]string{"X-Empty": {""}, "X-Mixed": {"", "a"}},
+		},
+		{
+			name:    "set-cookie kept",
+			headers: map[string][]string{"set-cookie": {"a=1"}, "Set-Cookie": {"a=1", "b=2"}},
+			want:    map[string][]string{"Set-Cookie": {"a=1", "b=2", "a=1"}},
+		},
+		{
+			name:    "singleton keeps first",
+			headers: map[string][]string{"content-type": {"text/html"}, "Content-Type": {"text/plain"}},
+			want:    map[string][]string{"Content-Type": {"text/plain"}},
+		},
+		{
+			name:    "strict singleton repeated",
+			headers: map[string][]string{"Content-Type": {"text/plain", "text/plain"}},
+			strict:  true,
+			want:    map[string][]string{"Content-Type": {"text/plain"}},
+		},
+		{
+			name:    "strict singleton conflict",
+			headers: map[string][]string{"content-type": {"text/html"}, "Content-Type": {"text/plain"}},
+			strict:  true,
+			wantErr: true,
+		},
+		{
+			name:    "oversized name",
+			headers: map[string][]string{strings.ToLower(longName): {"a"}, longName: {"a"}},
+			want:    map[string][]string{longName: {"a"}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := NormalizeHeaders(tc.headers, tc.strict)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %.200v, want %.200v", got, tc.want)
+			}
+		})
+	}
+}
+
+func testHandlerRequest(handler fasthttp.RequestHandler, uri string, headers [][2]string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.SetRequestURI(uri)
+	for _, hdr := range headers {
+		req.Header.Add(hdr[0], hdr[1])
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&req, nil, nil)
+	handler(ctx)
+	return ctx
+}
+
+// Request headers go from fasthttp to the worker, response headers come
+// back from the worker through NormalizeHeaders.
+func TestHandlerHeaderConversion(t *testing.T) {
+	p := newTestPool(t, testPoolConfig())
+	defer p.Close()
+	handler := MakeHTTPHandler(p, HandlerConfig{NormalizeHeaders: true})
+
+	longName := "X-Long" + strings.Repeat("n", 4096)
+	t.Run("request", func(t *testing.T) {
+		ctx := testHandlerRequest(handler, "/headers", [][2]string{
+			{"x-repeated", "a"},
+			{"X-Repeated", "b"},
+			{"X-Empty", ""},
+			{"x-lower", "c"},
+			{longName, "long"},
+		})
+		if ctx.Response.StatusCode() != 200 {
+			t.Fatalf("unexpected status %d", ctx.Response.StatusCode())
+		}
+		body := string(ctx.Response.Body())
+		for _, line := range []string{
+			"X-Repeated: b\n",
+			"X-Empty: \n",
+			"X-Lower: c\n",
+			longName + ": long\n",
+		} {
+			if !strings.Contains(body, line) {
+				t.Errorf("worker did not see %.40q in %.200q", line, body)
+			}
+		}
+		if strings.Contains(body, "X-Repeated: a\n") || strings.Contains(body, "x-") {
+			t.Errorf("unexpected headers in %.200q", body)
+		}
+	})
+
+	t.Run("response", func(t *testing.T) {
+		ctx := testHandlerRequest(handler, "/response-headers", nil)
+		if ctx.Response.StatusCode() != 200 {
+			t.Fatalf("unexpected status %d", ctx.Response.StatusCode())
+		}
+		got := make(map[string][]string)
+		ctx.Response.Header.VisitAll(func(key, value []byte) {
+			got[string(key)] = append(got[string(key)], string(value))
+		})
+		want := map[string][]string{
+			"X-Repeated":   {"c", "a", "b"},
+			"X-Empty":      {""},
+			"Content-Type": {"text/html"},
+			"Set-Cookie":   {"a=1", "a=1"},
+			longName:       {"long"},
+		}
+		for name, values := range want {
+			if !reflect.DeepEqual(got[name], values) {
+				t.Errorf("header %.40s: got %q, want %q", name, got[name], values)
+			}
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		handler := MakeHTTPHandler(p, HandlerConfig{NormalizeHeaders: true, StrictHeaders: true})
+		ctx := testHandlerRequest(handler, "/response-headers", nil)
+		if ctx.Response.StatusCode() != fasthttp.StatusInternalServerError {
+			t.Fatalf("expected conflicting Content-Type to fail, got status %d", ctx.Response.StatusCode())
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package poolparty
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// A SizeHistogram counts sizes in bytes in power of two buckets,
+// Buckets[i] counts sizes n where 1<<(i-1) <= n < 1<<i, so Buckets[0]
+// counts empty frames.
+type SizeHistogram struct {
+	Count   uint64
+	Bytes   uint64
+	Buckets [33]uint64
+}
+
+// sizeHistogram is updated from many workers at once.
+type sizeHistogram struct {
+	count   uint64
+	bytes   uint64
+	buckets [33]uint64
+}
+
+func (h *sizeHistogram) record(n uint32) {
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.bytes, uint64(n))
+	atomic.AddUint64(&h.buckets[bits.Len32(n)], 1)
+}
+
+func (h *sizeHistogram) snapshot() SizeHistogram {
+	s := SizeHistogram{
+		Count: atomic.LoadUint64(&h.count),
+		Bytes: atomic.LoadUint64(&h.bytes),
+	}
+	for i := range h.buckets {
+		s.Buckets[i] = atomic.LoadUint64(&h.buckets[i])
+	}
+	return s
+}
+
+func (s *SizeHistogram) add(o SizeHistogram) {
+	s.Count += o.Count
+	s.Bytes += o.Bytes
+	for i := range s.Buckets {
+		s.Buckets[i] += o.Buckets[i]
+	}
+}
@@ -0,0 +1,77 @@
+package poolparty
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Shared with callers waiting on a call whose f panicked.
+var errIdempotentCallPanicked = errors.New("idempotent request panicked")
+
+type idempotentCall struct {
+	// Closed once resp and err are set.
+	done    chan struct{}
+	resp    HTTPResponse
+	err     error
+	expires time.Time
+}
+
+type idempotencyCache struct {
+	mu        sync.Mutex
+	window    time.Duration
+	calls     map[string]*idempotentCall
+	lastSweep time.Time
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:    window,
+		calls:     make(map[string]*idempotentCall),
+		lastSweep: time.Now(),
+	}
+}
+
+// do calls f once for each key, callers with the same key as a call that
+// is in progress wait for it and share its outcome. Successful responses
+// are kept for the cache window, errors are shared only with callers
+// already waiting so a later retry runs again. If f panics, waiting
+// callers get errIdempotentCallPanicked and the panic continues.
+func (c *idempotencyCache) do(key string, f func() (HTTPResponse, error)) (HTTPResponse, error) {
+	c.mu.Lock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) > c.window {
+		for k, call := range c.calls {
+			if !call.expires.IsZero() && now.After(call.expires) {
+				delete(c.calls, k)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	call, ok := c.calls[key]
+	if ok && (call.expires.IsZero() || now.Before(call.expires)) {
+		c.mu.Unlock()
+		<-call.done
+		return call.resp, call.err
+	}
+
+	call = &idempotentCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer close(call.done)
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if call.err != nil {
+			delete(c.calls, key)
+		} else {
+			call.expires = time.Now().Add(c.window)
+		}
+	}()
+
+	call.err = errIdempotentCallPanicked
+	call.resp, call.err = f()
+	return call.resp, call.err
+}
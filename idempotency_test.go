@@ -0,0 +1,56 @@
+package poolparty
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCachePanic(t *testing.T) {
+	c := newIdempotencyCache(time.Minute)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	recovered := make(chan interface{})
+	go func() {
+		defer func() {
+			recovered <- recover()
+		}()
+		_, _ = c.do("key", func() (HTTPResponse, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+
+	<-started
+	waited := make(chan error)
+	go func() {
+		_, err := c.do("key", func() (HTTPResponse, error) {
+			t.Error("f called again while the first call was in progress")
+			return HTTPResponse{}, nil
+		})
+		waited <- err
+	}()
+	// Give the waiter time to find the call in progress.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	if r := <-recovered; r != "boom" {
+		t.Fatalf("expected the panic to continue, got %v", r)
+	}
+	select {
+	case err := <-waited:
+		if err != errIdempotentCallPanicked {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter was never released")
+	}
+
+	resp, err := c.do("key", func() (HTTPResponse, error) {
+		return HTTPResponse{Status: 200}, nil
+	})
+	if err != nil || resp.Status != 200 {
+		t.Fatalf("retry after a panic was not run again: %v %v", resp, err)
+	}
+}
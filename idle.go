@@ -0,0 +1,62 @@
+package poolparty
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// reapIdleWorkers removes workers that have handled no request for
+// IdleTimeout, down to MinWorkers, so memory is freed in quiet periods.
+// Workers are spawned again on demand as usual. Paused pools keep their
+// workers warm.
+func (p *WorkerPool) reapIdleWorkers() {
+	ticker := time.NewTicker(p.cfg.IdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.workerCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		if p.Paused() {
+			continue
+		}
+		now := time.Now()
+		for _, w := range p.liveWorkers() {
+			lastUsed := atomic.LoadInt64(&w.lastUsed)
+			if lastUsed == 0 {
+				continue
+			}
+			idle := now.Sub(time.Unix(0, lastUsed))
+			if idle >= p.cfg.IdleTimeout {
+				p.reapIdleWorker(w, idle)
+			}
+		}
+	}
+}
+
+func (p *WorkerPool) reapIdleWorker(w *liveWorker, idle time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.NumWorkers() <= p.cfg.MinWorkers {
+		return
+	}
+	for i, retiring := range p.retireWorker {
+		if retiring != w.retiring {
+			continue
+		}
+		// Unlike RemoveWorker the worker is never cancelled, if it took
+		// a request since it was checked it finishes it first.
+		close(retiring)
+		p.ctl = append(p.ctl[:i], p.ctl[i+1:]...)
+		p.cancelWorker = append(p.cancelWorker[:i], p.cancelWorker[i+1:]...)
+		p.retireWorker = append(p.retireWorker[:i], p.retireWorker[i+1:]...)
+		slots := p.slotStatsSnapshot()
+		p.slotStats.Store(append(append([]*workerSlotStats{}, slots[:i]...), slots[i+1:]...))
+		atomic.AddUint32(&p.numWorkers, ^uint32(0)) // Decrement
+		atomic.AddUint64(&p.idleReaped, 1)
+		p.log("msg", "reaping idle worker", "worker-pid", w.pid, "idle", idle)
+		return
+	}
+}
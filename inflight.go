@@ -0,0 +1,128 @@
+package poolparty
+
+import (
+	"sync"
+	"time"
+)
+
+// RequestInfo describes a dispatched request for CancelWhere.
+type RequestInfo struct {
+	RemoteAddress string
+	Uri           string
+	Method        string
+	// Shared with the request, must not be modified.
+	Headers map[string]string
+	Start   time.Time
+	// Zero while the request waits for a worker.
+	WorkerPid int
+}
+
+// inflightRequest is a request registered by dispatchWork until it
+// returns, so it can be found and cancelled by CancelWhere.
+type inflightRequest struct {
+	req   HTTPRequest
+	start time.Time
+	// Closed when cancelled, watched while the request is queued.
+	cancelled chan struct{}
+
+	mu           sync.Mutex
+	wasCancelled bool
+	workerPid    int
+	// Set while a worker handles the request, stops the worker.
+	abort func()
+}
+
+func (r *inflightRequest) info() RequestInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return RequestInfo{
+		RemoteAddress: r.req.RemoteAddress,
+		Uri:           r.req.Uri,
+		Method:        r.req.Method,
+		Headers:       r.req.Headers,
+		Start:         r.start,
+		WorkerPid:     r.workerPid,
+	}
+}
+
+// cancel returns false if the request was already cancelled.
+func (r *inflightRequest) cancel() bool {
+	r.mu.Lock()
+	if r.wasCancelled {
+		r.mu.Unlock()
+		return false
+	}
+	r.wasCancelled = true
+	close(r.cancelled)
+	abort := r.abort
+	r.mu.Unlock()
+	if abort != nil {
+		abort()
+	}
+	return true
+}
+
+// handle is called by the worker taking the request, it returns false
+// if the request was cancelled before that.
+func (r *inflightRequest) handle(pid int, abort func()) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.wasCancelled {
+		return false
+	}
+	r.workerPid = pid
+	r.abort = abort
+	return true
+}
+
+func (r *inflightRequest) handled() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.workerPid = 0
+	r.abort = nil
+}
+
+func (p *WorkerPool) registerInflight(req HTTPRequest) *inflightRequest {
+	r := &inflightRequest{
+		req:       req,
+		start:     time.Now(),
+		cancelled: make(chan struct{}),
+	}
+	p.inflightMu.Lock()
+	p.inflight[r] = struct{}{}
+	p.inflightMu.Unlock()
+	return r
+}
+
+func (p *WorkerPool) unregisterInflight(r *inflightRequest) {
+	p.inflightMu.Lock()
+	delete(p.inflight, r)
+	p.inflightMu.Unlock()
+}
+
+// CancelWhere cancels every dispatched request, queued or being handled,
+// for which pred returns true, e.g. all requests for one tenant during
+// an incident, and returns how many it cancelled. Their callers get an
+// error wrapping ErrRequestCancelled. The protocol has no way to stop a
+// request part way, so a worker handling a cancelled request is stopped
+// and replaced as if it had timed out. pred must not block or modify
+// the request's headers.
+func (p *WorkerPool) CancelWhere(pred func(RequestInfo) bool) int {
+	p.inflightMu.Lock()
+	requests := make([]*inflightRequest, 0, len(p.inflight))
+	for r := range p.inflight {
+		requests = append(requests, r)
+	}
+	p.inflightMu.Unlock()
+
+	n := 0
+	for _, r := range requests {
+		if pred(r.info()) && r.cancel() {
+			n += 1
+		}
+	}
+	if n != 0 {
+		p.log("msg", "cancelled requests", "count", n)
+	}
+	return n
+}
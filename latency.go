@@ -0,0 +1,95 @@
+package poolparty
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyEMA is an exponential moving average of latencies in
+// nanoseconds, updated from many dispatching goroutines at once.
+type latencyEMA struct {
+	alpha float64
+	ns    int64
+}
+
+func (e *latencyEMA) record(d time.Duration) {
+	for {
+		old := atomic.LoadInt64(&e.ns)
+		ema := int64(d)
+		if old != 0 {
+			ema = old + int64(e.alpha*float64(int64(d)-old))
+		}
+		if atomic.CompareAndSwapInt64(&e.ns, old, ema) {
+			return
+		}
+	}
+}
+
+func (e *latencyEMA) get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&e.ns))
+}
+
+// DurationStats summarizes a set of durations, all zero if Count is.
+type DurationStats struct {
+	Count uint64
+	Min   time.Duration
+	Max   time.Duration
+	Avg   time.Duration
+}
+
+// durationStats accumulates a DurationStats.
+type durationStats struct {
+	mu    sync.Mutex
+	count uint64
+	min   time.Duration
+	max   time.Duration
+	total time.Duration
+}
+
+func (s *durationStats) record(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 || d < s.min {
+		s.min = d
+	}
+	if d > s.max {
+		s.max = d
+	}
+	s.count += 1
+	s.total += d
+}
+
+// add combines o into s, as if their durations were recorded together.
+func (s *DurationStats) add(o DurationStats) {
+	if o.Count == 0 {
+		return
+	}
+	if s.Count == 0 {
+		*s = o
+		return
+	}
+	if o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if o.Max > s.Max {
+		s.Max = o.Max
+	}
+	count := s.Count + o.Count
+	s.Avg = time.Duration((float64(s.Avg)*float64(s.Count) + float64(o.Avg)*float64(o.Count)) / float64(count))
+	s.Count = count
+}
+
+func (s *durationStats) snapshot() DurationStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		return DurationStats{}
+	}
+	return DurationStats{
+		Count: s.count,
+		Min:   s.min,
+		Max:   s.max,
+		Avg:   s.total / time.Duration(s.count),
+	}
+}
@@ -0,0 +1,145 @@
+package poolparty
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// A liveWorker is a worker process that has completed its handshake.
+type liveWorker struct {
+	pid int
+	// Receives a reason when the worker should be replaced once it
+	// finishes its current request.
+	recycle chan string
+	// Updated by the worker goroutine after each request, see
+	// recordLatency.
+	latencyEMA int64
+	samples    int64
+	// Unix nanoseconds the worker last finished a request or started,
+	// 0 while it is handling one or quiesced, see IdleTimeout.
+	lastUsed int64
+	// The slot's retiring channel, see RetireGrace.
+	retiring chan struct{}
+}
+
+// recordLatency folds a request's latency into the worker's moving
+// average, which weights roughly the last 10 requests.
+func (w *liveWorker) recordLatency(d time.Duration) {
+	ema := atomic.LoadInt64(&w.latencyEMA)
+	if atomic.AddInt64(&w.samples, 1) == 1 {
+		ema = int64(d)
+	} else {
+		ema += (int64(d) - ema) / 10
+	}
+	atomic.StoreInt64(&w.latencyEMA, ema)
+}
+
+func (p *WorkerPool) addLiveWorker(w *liveWorker) {
+	p.liveMu.Lock()
+	defer p.liveMu.Unlock()
+	p.live[w] = struct{}{}
+	atomic.AddInt32(&p.numLive, 1)
+	close(p.liveChanged)
+	p.liveChanged = make(chan struct{})
+}
+
+func (p *WorkerPool) removeLiveWorker(w *liveWorker) {
+	p.liveMu.Lock()
+	defer p.liveMu.Unlock()
+	delete(p.live, w)
+	atomic.AddInt32(&p.numLive, -1)
+	close(p.liveChanged)
+	p.liveChanged = make(chan struct{})
+}
+
+func (p *WorkerPool) liveWorkerSet() map[*liveWorker]struct{} {
+	p.liveMu.Lock()
+	defer p.liveMu.Unlock()
+	set := make(map[*liveWorker]struct{}, len(p.live))
+	for w := range p.live {
+		set[w] = struct{}{}
+	}
+	return set
+}
+
+// waitNewLiveWorkers waits until at least n live workers are not in
+// old, e.g. until n replacements have finished starting.
+func (p *WorkerPool) waitNewLiveWorkers(ctx context.Context, old map[*liveWorker]struct{}, n int) error {
+	for {
+		p.liveMu.Lock()
+		newWorkers := 0
+		for w := range p.live {
+			if _, ok := old[w]; !ok {
+				newWorkers += 1
+			}
+		}
+		changed := p.liveChanged
+		p.liveMu.Unlock()
+		if newWorkers >= n {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.workerCtx.Done():
+			return ErrWorkerPoolClosed
+		case <-changed:
+		}
+	}
+}
+
+func (p *WorkerPool) liveWorkers() []*liveWorker {
+	p.liveMu.Lock()
+	defer p.liveMu.Unlock()
+	workers := make([]*liveWorker, 0, len(p.live))
+	for w := range p.live {
+		workers = append(workers, w)
+	}
+	return workers
+}
+
+// totalRSS sums the resident memory of all live workers, returning the
+// largest worker too. Workers that can't be measured are skipped, so it
+// is zero where that is unsupported.
+func (p *WorkerPool) totalRSS() (int64, *liveWorker) {
+	total := int64(0)
+	largest := int64(0)
+	var largestWorker *liveWorker
+	for _, w := range p.liveWorkers() {
+		rss, err := workerRSS(w.pid)
+		if err != nil {
+			continue
+		}
+		total += rss
+		if rss > largest {
+			largest = rss
+			largestWorker = w
+		}
+	}
+	return total, largestWorker
+}
+
+// limitTotalRSS recycles the largest worker each RSSCheckInterval for
+// as long as all workers together use more than MaxTotalRSSBytes.
+func (p *WorkerPool) limitTotalRSS() {
+	ticker := time.NewTicker(p.cfg.RSSCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.workerCtx.Done():
+			return
+		case <-ticker.C:
+			total, largest := p.totalRSS()
+			if total <= p.cfg.MaxTotalRSSBytes || largest == nil {
+				continue
+			}
+			p.log("msg", "workers over memory limit, recycling largest worker", "total-rss", total, "worker-pid", largest.pid)
+			select {
+			case largest.recycle <- "total memory limit exceeded":
+			default:
+				// Already asked to recycle.
+			}
+		}
+	}
+}
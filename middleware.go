@@ -0,0 +1,62 @@
+package poolparty
+
+import (
+	"time"
+)
+
+// A DispatchFunc handles a request the way WorkerPool.Dispatch does.
+type DispatchFunc func(req HTTPRequest) (HTTPResponse, error)
+
+// A Middleware wraps a DispatchFunc, it may inspect or change the
+// request, the response and the error, or answer without calling next.
+type Middleware func(next DispatchFunc) DispatchFunc
+
+// Use adds mw to the middleware Dispatch runs requests through, the
+// first middleware added sees each request first. The middleware runs
+// before SequenceKey, idempotency, sampling, shadowing and Fallback,
+// and is not applied by DispatchRawResponse or DispatchToWorker. Use
+// is safe to call while requests are being dispatched but is meant
+// for setting the pool up.
+func (p *WorkerPool) Use(mw Middleware) {
+	p.middlewareMu.Lock()
+	defer p.middlewareMu.Unlock()
+
+	p.middleware = append(p.middleware, mw)
+	h := DispatchFunc(p.dispatchWithHooks)
+	for i := len(p.middleware) - 1; i >= 0; i-- {
+		h = p.middleware[i](h)
+	}
+	p.dispatchChain.Store(h)
+}
+
+// LoggingMiddleware logs the method, uri, status, duration and error of
+// every request.
+func LoggingMiddleware(logfn func(keyvals ...interface{})) Middleware {
+	return func(next DispatchFunc) DispatchFunc {
+		return func(req HTTPRequest) (HTTPResponse, error) {
+			start := time.Now()
+			resp, err := next(req)
+			kvs := []interface{}{"msg", "dispatched request", "method", req.Method, "uri", req.Uri, "duration", time.Since(start)}
+			if err != nil {
+				kvs = append(kvs, "err", err)
+			} else {
+				kvs = append(kvs, "status", resp.Status)
+			}
+			logfn(kvs...)
+			return resp, err
+		}
+	}
+}
+
+// TimingMiddleware calls observe with how long each request took to
+// dispatch and its error, e.g. to feed a latency histogram.
+func TimingMiddleware(observe func(req HTTPRequest, d time.Duration, err error)) Middleware {
+	return func(next DispatchFunc) DispatchFunc {
+		return func(req HTTPRequest) (HTTPResponse, error) {
+			start := time.Now()
+			resp, err := next(req)
+			observe(req, time.Since(start), err)
+			return resp, err
+		}
+	}
+}
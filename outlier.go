@@ -0,0 +1,70 @@
+package poolparty
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// A worker must be an outlier for this many checks in a row before it
+// is ejected, so a single slow request doesn't cost a worker.
+const outlierStrikes = 3
+
+// ejectOutliers recycles a worker whose average latency stays above
+// OutlierLatencyFactor times the median of all workers with at least
+// OutlierMinSamples requests. At most one worker is ejected per check,
+// and only when there are at least three workers to compare.
+func (p *WorkerPool) ejectOutliers() {
+	ticker := time.NewTicker(p.cfg.OutlierCheckInterval)
+	defer ticker.Stop()
+	strikes := make(map[*liveWorker]int)
+	for {
+		select {
+		case <-p.workerCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		workers := []*liveWorker{}
+		latencies := []int64{}
+		for _, w := range p.liveWorkers() {
+			if atomic.LoadInt64(&w.samples) >= int64(p.cfg.OutlierMinSamples) {
+				workers = append(workers, w)
+				latencies = append(latencies, atomic.LoadInt64(&w.latencyEMA))
+			}
+		}
+
+		seen := make(map[*liveWorker]int, len(workers))
+		if len(workers) >= 3 {
+			sorted := append([]int64{}, latencies...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+			median := sorted[len(sorted)/2]
+			threshold := int64(float64(median) * p.cfg.OutlierLatencyFactor)
+
+			ejected := false
+			for i, w := range workers {
+				if latencies[i] <= threshold {
+					continue
+				}
+				seen[w] = strikes[w] + 1
+				if seen[w] < outlierStrikes || ejected {
+					continue
+				}
+				select {
+				case w.recycle <- "latency outlier":
+				default:
+					continue
+				}
+				ejected = true
+				latency := time.Duration(latencies[i])
+				p.log("msg", "ejecting latency outlier worker", "worker-pid", w.pid, "latency", latency, "median-latency", time.Duration(median))
+				if p.cfg.OnWorkerEvent != nil {
+					p.cfg.OnWorkerEvent(HTTPRequest{}, "outlier-ejected", []byte(fmt.Sprintf("pid=%d latency=%s median-latency=%s", w.pid, latency, time.Duration(median))))
+				}
+			}
+		}
+		// Workers that recovered or went away start again from zero.
+		strikes = seen
+	}
+}
@@ -0,0 +1,29 @@
+package poolparty
+
+import (
+	"os"
+	"syscall"
+)
+
+// From linux/fcntl.h, not in the syscall package.
+const fSETPIPE_SZ = 1031
+
+// setPipeSize sets the capacity of the pipe f is one end of, the kernel
+// rounds it up to a power of two pages.
+func setPipeSize(f *os.File, size int) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, fSETPIPE_SZ, uintptr(size))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package poolparty
+
+import (
+	"errors"
+	"os"
+)
+
+func setPipeSize(f *os.File, size int) error {
+	return errors.New("setting the pipe size is only supported on linux")
+}
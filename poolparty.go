@@ -8,8 +8,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"os/exec"
+	"regexp"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -23,45 +26,174 @@ import (
 var (
 	ErrWorkerPoolBusy   = errors.New("worker pool busy")
 	ErrWorkerPoolClosed = errors.New("worker pool closed")
+	ErrWorkerPoolPaused = errors.New("worker pool paused")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrPoolNotReady     = errors.New("worker pool not ready")
+	ErrWorkerTimeout    = errors.New("worker request timed out")
+	ErrUnknownPool      = errors.New("unknown worker pool")
+	ErrQueueTimeout     = errors.New("total timeout expired waiting for a worker")
+	ErrExecTimeout      = errors.New("total timeout expired handling the request")
+	ErrInvalidResponse  = errors.New("worker sent an invalid response")
+	ErrNoHealthyWorkers = errors.New("no healthy workers")
+	ErrInvalidRequest   = errors.New("invalid request")
+	ErrRequestCancelled = errors.New("request cancelled")
 )
 
 type PoolConfig struct {
-	Logfn                     func(keyvals ...interface{})
-	MinWorkers                uint32
-	MaxWorkers                uint32
-	OnWorkerOutput            func(ln []byte)
-	WorkerProc                []string
-	WorkerSpawnTimeout        time.Duration
-	WorkerRendezvousTimeout   time.Duration
-	WorkerRequestTimeout      time.Duration
-	WorkerRestartDelay        time.Duration
-	WorkerAttritionDelay      time.Duration
-	WorkerHealthCheckInterval time.Duration
+	Logfn                       func(keyvals ...interface{})
+	LogFields                   func(req HTTPRequest) []interface{}
+	RequestValidator            func(req HTTPRequest) error
+	Admission                   AdmissionController
+	MinWorkers                  uint32
+	MaxWorkers                  uint32
+	OnWorkerOutput              func(ln []byte)
+	OnWorkerEvent               func(req HTTPRequest, kind string, data []byte)
+	FatalOutputPatterns         []*regexp.Regexp
+	SampleRate                  uint64
+	OnSample                    func(req HTTPRequest, resp HTTPResponse, err error)
+	Fallback                    func(req HTTPRequest, err error) (HTTPResponse, bool)
+	SequenceKey                 func(req HTTPRequest) string
+	UsageTag                    func(req HTTPRequest) string
+	MaxUsageTags                int
+	ShadowPool                  *WorkerPool
+	ShadowRate                  float64
+	OnShadow                    func(req HTTPRequest, resp HTTPResponse, err error, shadowResp HTTPResponse, shadowErr error)
+	WorkerProc                  []string
+	WorkerExtraFiles            []*os.File
+	WorkerCoreDumps             bool
+	WorkerSetupProc             []string
+	WarmupRequests              []HTTPRequest
+	MaxTotalRSSBytes            int64
+	RSSCheckInterval            time.Duration
+	OutlierLatencyFactor        float64
+	OutlierMinSamples           int
+	OutlierCheckInterval        time.Duration
+	LatencyEMAAlpha             float64
+	CrashLogRequests            int
+	LastErrorClearAfter         int
+	WatchPaths                  []string
+	WatchInterval               time.Duration
+	WatchDebounce               time.Duration
+	WorkerSpawnTimeout          time.Duration
+	WorkerRendezvousTimeout     time.Duration
+	FIFODispatch                bool
+	WarmRestarts                bool
+	WorkerRequestTimeout        time.Duration
+	WorkerWriteTimeout          time.Duration
+	MaxRequestTimeout           time.Duration
+	MaxWorkerCPUTime            time.Duration
+	TotalTimeout                time.Duration
+	WorkerRestartDelay          time.Duration
+	MaxRestartsPerWindow        int
+	RestartWindow               time.Duration
+	StopRestartsOnTrip          bool
+	WorkerAttritionDelay        time.Duration
+	IdleTimeout                 time.Duration
+	WorkerHealthCheckInterval   time.Duration
+	WorkerHealthCheckJitter     float64
+	WorkerMaxResponseSize       uint32
+	RequestLogLimit             int
+	SpillThreshold              int64
+	SpillDir                    string
+	PipeBufferSize              int
+	RejectWhenPaused            bool
+	RejectUntilReady            bool
+	FailFastWithoutWorkers      bool
+	RecycleOnInvalidResponse    bool
+	WorkerShutdownTimeout       time.Duration
+	RetireGrace                 time.Duration
+	LameduckDuration            time.Duration
+	WorkerPrepareRecycleTimeout time.Duration
+	WorkerHandshakeTimeout      time.Duration
+	IdempotencyKeyHeader        string
+	IdempotencyWindow           time.Duration
 }
 
+// The bare decoder refuses data larger than this, so it is also the
+// largest response we can hold in memory. Spilled and streamed bodies
+// are copied straight from the pipe, so only WorkerMaxResponseSize
+// applies to them.
+const maxWorkerResponseSize = 32 * 1024 * 1024
+
+// HTTPRequest is a request as sent to a worker. Headers holds one value
+// per header name, repeated request headers keep only the last value.
 type HTTPRequest struct {
 	RemoteAddress string
 	Uri           string
 	Method        string
 	Headers       map[string]string
 	Body          []byte
-	RespChan      chan workResponse
 }
 
 type workRequest struct {
 	Req      HTTPRequest
 	RespChan chan workResponse
+	// Zero unless TotalTimeout is set.
+	Deadline    time.Time
+	Mode        responseMode
+	CollectLogs bool
+	// Only set with streamResponse.
+	Stream *responseStream
+	// Set by dispatchWork, see CancelWhere.
+	Inflight *inflightRequest
+}
+
+// responseMode is how a worker's HTTPResponse is delivered.
+type responseMode int
+
+const (
+	decodeResponse responseMode = iota
+	// Undecoded, see DispatchRawResponse.
+	rawResponse
+	// Decoded, but a large body is written to a file, see DispatchSpill.
+	spillResponse
+	// Decoded, but the body is written to Stream, see DispatchTo.
+	streamResponse
+)
+
+// pendingWork is a workRequest being handled by a worker, its caller is
+// answered at most once however many parties try, so a timeout can
+// answer before the worker goroutine gives up on the pipes.
+type pendingWork struct {
+	workRequest
+	answered int32
+}
+
+func (w *pendingWork) answer(resp workResponse) {
+	if atomic.CompareAndSwapInt32(&w.answered, 0, 1) {
+		w.RespChan <- resp
+	}
 }
 
+// HTTPResponse is a response as returned by a worker. Headers maps each
+// header name to all of its values in order, every value becomes a
+// separate header line in the http response.
 type HTTPResponse struct {
 	Status  int
 	Headers map[string][]string
 	Body    []byte
 }
 
+// A HandlerError is returned when the worker's request handler raised an
+// error, the worker itself is still healthy.
+type HandlerError struct {
+	Msg string
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("worker handler error: %s", e.Msg)
+}
+
 type workResponse struct {
 	Err  error
 	Resp HTTPResponse
+	// Set instead of Resp for rawResponse requests.
+	Raw []byte
+	// Set for spillResponse requests whose body was written to a file,
+	// instead of Resp.Body.
+	Spilled *os.File
+	// The worker's log events, for CollectLogs requests.
+	Logs []byte
 }
 
 type ctlRequest struct {
@@ -70,6 +202,16 @@ type ctlRequest struct {
 }
 
 type restartWorkerProcRequest struct{}
+type broadcastRequest struct {
+	req HTTPRequest
+}
+type directRequest struct {
+	req HTTPRequest
+}
+type quiesceWorkerRequest struct {
+	d       time.Duration
+	release chan struct{}
+}
 type removeWorkerProcRequest struct{}
 
 type WorkerPool struct {
@@ -82,8 +224,66 @@ type WorkerPool struct {
 	ctl              []chan ctlRequest
 	numWorkers       uint32
 	cancelWorker     []func()
+	retireWorker     []chan struct{} // Closed to remove a worker once it is idle, see RetireGrace.
+	slotStats        atomic.Value    // []*workerSlotStats, see slotStatsSnapshot.
 	attritionMarker  int32
 	workerRestarts   uint64
+	restartGuard     restartGuard
+	idleReaped       uint64
+	sampleCounter    uint64
+	requests         uint64
+	rateLimited      uint64
+	ready            int32
+	requestSizes     sizeHistogram
+	responseSizes    sizeHistogram
+	latency          latencyEMA
+	spawnDurations   durationStats
+	warmupDurations  durationStats
+	pauseMu          sync.Mutex
+	pause            pauseState
+	inFlight         int64
+	lameduck         int32
+	draining         int32
+	runningWorkers   int32
+	drainNotify      chan struct{}
+	shutdownMu       sync.Mutex
+	closing          bool
+	shutdownReport   ShutdownReport
+	// Requests in flight when shutdown began, see beginShutdown.
+	shutdownInflight map[*inflightRequest]struct{}
+	idempotency      *idempotencyCache
+	sequencer        *sequencer
+	usage            *usageMeter
+	fifo             *fifoQueue
+	logfn            atomic.Value // func(keyvals ...interface{}), see SetLogfn.
+	liveMu           sync.Mutex
+	live             map[*liveWorker]struct{}
+	liveChanged      chan struct{} // Closed and replaced when live changes.
+	numLive          int32
+	failingWorkers   int32 // Worker slots whose last worker failed to start or crashed.
+	directDispatch   int32 // Set while a DispatchToWorker is in progress.
+	middlewareMu     sync.Mutex
+	middleware       []Middleware
+	dispatchChain    atomic.Value // DispatchFunc, see Use.
+	idleMu           sync.Mutex
+	idle             idleState
+	activeMu         sync.Mutex
+	active           activeState // See WaitIdle.
+	inflightMu       sync.Mutex
+	inflight         map[*inflightRequest]struct{} // See CancelWhere.
+}
+
+type idleState struct {
+	idleWorkers int
+	// Closed while idleWorkers > 0 or the pool is closed.
+	ch     chan struct{}
+	closed bool
+}
+
+type pauseState struct {
+	paused bool
+	// Closed when the pool is paused or resumed.
+	changed chan struct{}
 }
 
 func NewWorkerPool(cfg PoolConfig) (*WorkerPool, error) {
@@ -108,6 +308,73 @@ func NewWorkerPool(cfg PoolConfig) (*WorkerPool, error) {
 	if len(cfg.WorkerProc) <= 0 {
 		return nil, errors.New("pool worker proc must not be empty")
 	}
+	if _, err := exec.LookPath(cfg.WorkerProc[0]); err != nil {
+		if strings.Contains(cfg.WorkerProc[0], "/") {
+			return nil, fmt.Errorf("worker binary %s not found or not executable: %w", cfg.WorkerProc[0], err)
+		}
+		return nil, fmt.Errorf("worker binary %s not found in PATH", cfg.WorkerProc[0])
+	}
+	if cfg.WorkerHandshakeTimeout == 0 {
+		cfg.WorkerHandshakeTimeout = cfg.WorkerRequestTimeout
+	}
+	if cfg.WorkerMaxResponseSize == 0 {
+		cfg.WorkerMaxResponseSize = maxWorkerResponseSize
+	}
+	if cfg.RequestLogLimit == 0 {
+		cfg.RequestLogLimit = 64 * 1024
+	}
+	if cfg.SpillThreshold < 0 {
+		return nil, errors.New("pool spill threshold must not be negative")
+	}
+	if cfg.WorkerHealthCheckJitter < 0 || cfg.WorkerHealthCheckJitter > 1 {
+		return nil, errors.New("pool worker health check jitter must be between 0 and 1")
+	}
+	if cfg.MaxRequestTimeout != 0 && cfg.MaxRequestTimeout < cfg.WorkerRequestTimeout {
+		return nil, errors.New("max request timeout must not be less than the worker request timeout")
+	}
+	if cfg.ShadowPool != nil && cfg.OnShadow == nil {
+		return nil, errors.New("pool shadow pool set without a shadow function")
+	}
+	if cfg.LatencyEMAAlpha == 0 {
+		cfg.LatencyEMAAlpha = 0.1
+	}
+	if cfg.LatencyEMAAlpha < 0 || cfg.LatencyEMAAlpha > 1 {
+		return nil, errors.New("pool latency EMA alpha must be between 0 and 1")
+	}
+	if cfg.OutlierMinSamples == 0 {
+		cfg.OutlierMinSamples = 20
+	}
+	if cfg.OutlierCheckInterval == 0 {
+		cfg.OutlierCheckInterval = 10 * time.Second
+	}
+	if cfg.RSSCheckInterval == 0 {
+		cfg.RSSCheckInterval = 5 * time.Second
+	}
+	if cfg.WatchInterval == 0 {
+		cfg.WatchInterval = time.Second
+	}
+	if cfg.LastErrorClearAfter < 0 {
+		return nil, errors.New("pool last error clear after count must not be negative")
+	}
+	if cfg.MaxRestartsPerWindow < 0 {
+		return nil, errors.New("pool max restarts per window must not be negative")
+	}
+	if cfg.RestartWindow == 0 {
+		cfg.RestartWindow = time.Minute
+	}
+	if cfg.IdleTimeout < 0 {
+		return nil, errors.New("pool idle timeout must not be negative")
+	}
+	if cfg.SampleRate != 0 && cfg.OnSample == nil {
+		return nil, errors.New("pool sample rate set without a sample function")
+	}
+
+	if len(cfg.WorkerSetupProc) > 0 {
+		err := runWorkerSetup(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	attritionTicker := time.NewTicker(cfg.WorkerAttritionDelay)
 
@@ -120,13 +387,78 @@ func NewWorkerPool(cfg PoolConfig) (*WorkerPool, error) {
 		dispatch:         make(chan workRequest),
 		ctl:              []chan ctlRequest{},
 		cancelWorker:     []func(){},
+		retireWorker:     []chan struct{}{},
 		attritionMarker:  1, // Start wanting a check.
+		pause:            pauseState{changed: make(chan struct{})},
+		idle:             idleState{ch: make(chan struct{})},
+		restartGuard:     restartGuard{reset: make(chan struct{})},
+		drainNotify:      make(chan struct{}, 1),
+		live:             make(map[*liveWorker]struct{}),
+		inflight:         make(map[*inflightRequest]struct{}),
+		liveChanged:      make(chan struct{}),
+		latency:          latencyEMA{alpha: cfg.LatencyEMAAlpha},
+	}
+
+	p.logfn.Store(cfg.Logfn)
+
+	if cfg.FIFODispatch {
+		p.fifo = &fifoQueue{}
+	}
+
+	if cfg.SequenceKey != nil {
+		p.sequencer = newSequencer()
+	}
+
+	if cfg.UsageTag != nil {
+		if cfg.MaxUsageTags == 0 {
+			cfg.MaxUsageTags = 10000
+		}
+		p.usage = newUsageMeter(cfg.MaxUsageTags)
+	}
+
+	if cfg.IdempotencyWindow > 0 {
+		if p.cfg.IdempotencyKeyHeader == "" {
+			p.cfg.IdempotencyKeyHeader = "Idempotency-Key"
+		}
+		p.idempotency = newIdempotencyCache(cfg.IdempotencyWindow)
 	}
 
 	for i := uint32(0); i < cfg.MinWorkers; i++ {
 		p.SpawnWorker()
 	}
 
+	if cfg.MaxTotalRSSBytes > 0 {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.limitTotalRSS()
+		}()
+	}
+
+	if cfg.IdleTimeout > 0 {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.reapIdleWorkers()
+		}()
+	}
+
+	if cfg.OutlierLatencyFactor > 0 {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.ejectOutliers()
+		}()
+	}
+
+	if len(cfg.WatchPaths) != 0 {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.watchPaths()
+		}()
+	}
+
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
@@ -139,7 +471,8 @@ func NewWorkerPool(cfg PoolConfig) (*WorkerPool, error) {
 				// If the attrition marker remains 1 for a whole tick, remove a worker.
 				shouldRemove := atomic.LoadInt32(&p.attritionMarker) == 1
 				atomic.StoreInt32(&p.attritionMarker, 1)
-				if shouldRemove {
+				// Paused pools keep their workers warm.
+				if shouldRemove && !p.Paused() {
 					p.RemoveWorker()
 				}
 			}
@@ -149,21 +482,270 @@ func NewWorkerPool(cfg PoolConfig) (*WorkerPool, error) {
 	return p, nil
 }
 
+// runWorkerSetup runs WorkerSetupProc once before any worker is started,
+// so expensive shared state such as a large read only data file can be
+// built once and then opened or memory mapped by every worker.
+func runWorkerSetup(cfg PoolConfig) error {
+	var cmd *exec.Cmd
+	if len(cfg.WorkerSetupProc) > 1 {
+		cmd = exec.Command(cfg.WorkerSetupProc[0], cfg.WorkerSetupProc[1:]...)
+	} else {
+		cmd = exec.Command(cfg.WorkerSetupProc[0])
+	}
+	cmd.ExtraFiles = cfg.WorkerExtraFiles
+	output, err := cmd.CombinedOutput()
+	for _, ln := range bytes.SplitAfter(output, []byte{'\n'}) {
+		if len(ln) != 0 {
+			cfg.OnWorkerOutput(ln)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("worker setup failed: %w", err)
+	}
+	return nil
+}
+
+// requestLogfn returns logfn with the LogFields of req added to each
+// line, or logfn itself if LogFields is not set.
+func (p *WorkerPool) requestLogfn(logfn func(keyvals ...interface{}), req HTTPRequest) func(keyvals ...interface{}) {
+	if p.cfg.LogFields == nil {
+		return logfn
+	}
+	fields := p.cfg.LogFields(req)
+	return func(keyvals ...interface{}) {
+		logfn(append(keyvals, fields...)...)
+	}
+}
+
+func (p *WorkerPool) log(keyvals ...interface{}) {
+	p.logfn.Load().(func(keyvals ...interface{}))(keyvals...)
+}
+
+// SetLogfn replaces the pool's log function, running workers use
+// the new function from their next log line.
+func (p *WorkerPool) SetLogfn(logfn func(keyvals ...interface{})) {
+	if logfn == nil {
+		logfn = func(v ...interface{}) {}
+	}
+	p.logfn.Store(logfn)
+}
+
+// WorkerPoolStats counters only increase, the request rate is the
+// change in Requests over time. RequestSizes and ResponseSizes are
+// the sizes of the frames exchanged with workers, including framing.
+// AvgLatencyEMA is a moving average, weighted by LatencyEMAAlpha, of
+// the time from dispatch to response of requests a worker took,
+// including the wait for a worker. SpawnDurations are the times from
+// starting each worker to the end of its handshake, WarmupDurations
+// the times each then took to answer its WarmupRequests.
 type WorkerPoolStats struct {
 	Workers        uint32
 	WorkerRestarts uint64
+	Paused         bool
+	Requests       uint64
+	RateLimited    uint64
+	RequestSizes   SizeHistogram
+	ResponseSizes  SizeHistogram
+	// Zero where worker memory can't be measured.
+	TotalRSSBytes int64
+	AvgLatencyEMA time.Duration
+	IdleReaped    uint64
+	// Of workers that started successfully.
+	SpawnDurations  DurationStats
+	WarmupDurations DurationStats
+	// See MaxRestartsPerWindow.
+	RestartGuardTripped bool
+	// Only set by PoolSet.Stats, see there.
+	WeightedShares map[string]float64
 }
 
 func (p *WorkerPool) Stats() WorkerPoolStats {
+	totalRSS, _ := p.totalRSS()
 	return WorkerPoolStats{
-		Workers:        p.NumWorkers(),
-		WorkerRestarts: atomic.LoadUint64(&p.workerRestarts),
+		Workers:             p.NumWorkers(),
+		WorkerRestarts:      atomic.LoadUint64(&p.workerRestarts),
+		Paused:              p.Paused(),
+		Requests:            atomic.LoadUint64(&p.requests),
+		RateLimited:         atomic.LoadUint64(&p.rateLimited),
+		RequestSizes:        p.requestSizes.snapshot(),
+		ResponseSizes:       p.responseSizes.snapshot(),
+		TotalRSSBytes:       totalRSS,
+		AvgLatencyEMA:       p.latency.get(),
+		IdleReaped:          atomic.LoadUint64(&p.idleReaped),
+		SpawnDurations:      p.spawnDurations.snapshot(),
+		WarmupDurations:     p.warmupDurations.snapshot(),
+		RestartGuardTripped: p.restartGuardTripped(),
+	}
+}
+
+// workerReadFrame reads a single length prefixed response into buf.
+func workerReadFrame(p *WorkerPool, in io.Reader, buf *bytes.Buffer) error {
+	respLen, err := workerReadFrameLen(p, in)
+	if err != nil {
+		return err
+	}
+	err = checkBufferedFrameLen(respLen)
+	if err != nil {
+		return err
+	}
+	return workerReadFrameBody(in, buf, respLen)
+}
+
+// checkBufferedFrameLen rejects a frame too large to be read into memory,
+// even if WorkerMaxResponseSize allows it.
+func checkBufferedFrameLen(respLen uint32) error {
+	if respLen > maxWorkerResponseSize {
+		return fmt.Errorf("response of %d bytes exceeds the maximum of %d bytes unless spilled or streamed", respLen, maxWorkerResponseSize)
+	}
+	return nil
+}
+
+func workerReadFrameLen(p *WorkerPool, in io.Reader) (uint32, error) {
+	lenBuf := [4]byte{}
+	_, err := io.ReadFull(in, lenBuf[:])
+	if err != nil {
+		return 0, fmt.Errorf("unable to worker read response length: %w", err)
+	}
+
+	respLen := binary.LittleEndian.Uint32(lenBuf[:])
+	if respLen > p.cfg.WorkerMaxResponseSize {
+		return 0, fmt.Errorf("response of %d bytes exceeds the maximum of %d bytes", respLen, p.cfg.WorkerMaxResponseSize)
+	}
+	return respLen, nil
+}
+
+func workerReadFrameBody(in io.Reader, buf *bytes.Buffer, respLen uint32) error {
+	buf.Reset()
+	buf.Grow(int(respLen))
+
+	n, err := buf.ReadFrom(&io.LimitedReader{R: in, N: int64(respLen)})
+	if err != nil {
+		return fmt.Errorf("unable to read response: %w", err)
+	}
+	if n != int64(respLen) {
+		return fmt.Errorf("response truncated after %d of %d bytes", n, respLen)
+	}
+	return nil
+}
+
+const (
+	transientSpawnRetryDelay = 50 * time.Millisecond
+	maxSpawnRetryDelay       = 60 * time.Second
+)
+
+// isTransientSpawnError reports whether starting a worker failed for a
+// reason that is likely to pass by itself, such as an interrupted system
+// call or running out of file descriptors, rather than a broken WorkerProc.
+func isTransientSpawnError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EINTR, syscall.EAGAIN, syscall.EMFILE, syscall.ENFILE, syscall.ENOMEM} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// The version of the worker protocol, exchanged in a handshake when a
+// worker starts. Bump this when making incompatible protocol changes.
+const protocolVersion = 1
+
+// errProtocolMismatch is returned by workerHandshake for a worker that
+// answered but doesn't speak our protocol.
+var errProtocolMismatch = errors.New("protocol mismatch")
+
+// workerHandshake checks a newly started worker speaks our protocol
+// version before it is given any requests.
+func workerHandshake(p *WorkerPool, out io.Writer, in io.Reader) error {
+	// size=2 ++ variant=2 ++ version.
+	_, err := out.Write([]byte{2, 0, 0, 0, 2, protocolVersion})
+	if err != nil {
+		return fmt.Errorf("writing handshake failed: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = workerReadFrame(p, in, &buf)
+	if err != nil {
+		return err
+	}
+
+	br := bare.NewReader(&buf)
+	variant, _ := br.ReadUint()
+	if variant != 2 {
+		return fmt.Errorf("%w, worker sent response variant %d to the handshake", errProtocolMismatch, variant)
+	}
+	version, _ := br.ReadUint()
+	if version != protocolVersion {
+		return fmt.Errorf("%w, worker speaks version %d, want version %d", errProtocolMismatch, version, protocolVersion)
+	}
+	return nil
+}
+
+// workerPrepareRecycle tells a worker it is about to be replaced and
+// waits for it to acknowledge, so it can save any state first.
+func workerPrepareRecycle(p *WorkerPool, out io.Writer, in io.Reader) error {
+	// size=1 ++ variant=3.
+	_, err := out.Write([]byte{1, 0, 0, 0, 3})
+	if err != nil {
+		return fmt.Errorf("writing prepare recycle request failed: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = workerReadFrame(p, in, &buf)
+	if err != nil {
+		return err
+	}
+
+	br := bare.NewReader(&buf)
+	variant, _ := br.ReadUint()
+	if variant != 4 {
+		return fmt.Errorf("worker sent response variant %d to the prepare recycle request", variant)
+	}
+	return nil
+}
+
+// requestTiming tracks how long writing a request to a worker and then
+// waiting for its response take, a worker that stopped reading its stdin
+// is stuck writing while a slow handler is stuck reading.
+type requestTiming struct {
+	start time.Time
+	// Nanoseconds after start the request was completely written, zero
+	// until then.
+	written int64
+	// Called for heartbeat events if MaxRequestTimeout is set.
+	heartbeat func()
+}
+
+func (t *requestTiming) markWritten() {
+	atomic.StoreInt64(&t.written, int64(time.Since(t.start))+1)
+}
+
+func (t *requestTiming) phases() (writeTime, readTime time.Duration, writing bool) {
+	elapsed := time.Since(t.start)
+	written := time.Duration(atomic.LoadInt64(&t.written))
+	if written == 0 {
+		return elapsed, 0, true
 	}
+	return written, elapsed - written, false
 }
 
-func workerHandleRequest(ctx context.Context, p *WorkerPool, workReq workRequest, out io.Writer, in io.Reader) (ok bool) {
-	ok = false
+func (t *requestTiming) String() string {
+	writeTime, readTime, writing := t.phases()
+	if writing {
+		return fmt.Sprintf("while writing the request after %s", writeTime)
+	}
+	return fmt.Sprintf("after writing the request in %s and waiting %s for the response", writeTime, readTime)
+}
 
+// workerHandleRequest performs a single request/response exchange with
+// a worker. Any error other than a *HandlerError or ErrInvalidResponse
+// means the worker's pipes are in an unknown state and the worker must be
+// restarted. The worker may also ask to be recycled once the response is
+// delivered.
+//
+// Before its response a worker may send any number of events, these are
+// passed to onEvent from the worker goroutine while the request timeout
+// keeps running, so onEvent should return quickly.
+func workerHandleRequest(ctx context.Context, p *WorkerPool, req HTTPRequest, out io.Writer, in io.Reader, timing *requestTiming, mode responseMode, stream *responseStream, onEvent func(kind string, data []byte)) (resp HTTPResponse, rawResp []byte, spilled *os.File, recycle bool, err error) {
 	var buf bytes.Buffer
 	buf.Grow(256)
 	bw := bare.NewWriter(&buf)
@@ -171,71 +753,94 @@ func workerHandleRequest(ctx context.Context, p *WorkerPool, workReq workRequest
 	_ = bw.WriteU32(0)
 	// Request variant.
 	_ = bw.WriteUint(0)
-	_ = bw.WriteString(workReq.Req.RemoteAddress)
-	_ = bw.WriteString(workReq.Req.Uri)
-	_ = bw.WriteString(workReq.Req.Method)
-	_ = bw.WriteUint(uint64(len(workReq.Req.Headers)))
-	for k, v := range workReq.Req.Headers {
+	_ = bw.WriteString(req.RemoteAddress)
+	_ = bw.WriteString(req.Uri)
+	_ = bw.WriteString(req.Method)
+	_ = bw.WriteUint(uint64(len(req.Headers)))
+	for k, v := range req.Headers {
 		_ = bw.WriteString(k)
 		_ = bw.WriteString(v)
 	}
-	_ = bw.WriteUint(uint64(len(workReq.Req.Body)))
+	_ = bw.WriteUint(uint64(len(req.Body)))
 
 	bufBytes := buf.Bytes()
 
-	reqLen := len(bufBytes) + len(workReq.Req.Body) - 4
+	reqLen := len(bufBytes) + len(req.Body) - 4
 	if reqLen > 0x7fffffff {
-		workReq.RespChan <- workResponse{Err: fmt.Errorf("request body too large")}
-		return
+		return HTTPResponse{}, nil, nil, false, fmt.Errorf("request body too large")
 	}
 
 	binary.LittleEndian.PutUint32(bufBytes, uint32(reqLen))
+	p.requestSizes.record(uint32(reqLen) + 4)
 
-	_, err := out.Write(buf.Bytes())
-	if err != nil {
-		workReq.RespChan <- workResponse{Err: fmt.Errorf("writing header failed: %w", err)}
-		return
-	}
-
-	_, err = out.Write(workReq.Req.Body)
+	_, err = out.Write(buf.Bytes())
 	if err != nil {
-		workReq.RespChan <- workResponse{Err: fmt.Errorf("writing body failed: %w", err)}
-		return
+		return HTTPResponse{}, nil, nil, false, fmt.Errorf("writing header failed %s: %w", timing, err)
 	}
 
-	lenBuf := [4]byte{}
-	_, err = in.Read(lenBuf[:])
+	_, err = out.Write(req.Body)
 	if err != nil {
-		workReq.RespChan <- workResponse{Err: fmt.Errorf("unable to worker read response length: %w", err)}
-		return
-	}
-
-	respLen := binary.LittleEndian.Uint32(lenBuf[:])
-	if respLen > 0x7fffffff {
-		workReq.RespChan <- workResponse{Err: fmt.Errorf("response too large")}
-		return
+		return HTTPResponse{}, nil, nil, false, fmt.Errorf("writing body failed %s: %w", timing, err)
 	}
+	timing.markWritten()
+
+	var br *bare.Reader
+	var variant uint64
+	for {
+		if mode == spillResponse || mode == streamResponse {
+			resp, spilled, recycle, err = workerReadSpillFrame(p, in, &buf, stream)
+			if err == nil && (spilled != nil || resp.Status != 0) {
+				return resp, nil, spilled, recycle, nil
+			}
+		} else {
+			err = workerReadFrame(p, in, &buf)
+		}
+		if err != nil {
+			if errors.Is(err, ErrInvalidResponse) {
+				return HTTPResponse{}, nil, nil, recycle, err
+			}
+			return HTTPResponse{}, nil, nil, false, fmt.Errorf("%w %s", err, timing)
+		}
 
-	buf.Reset()
-	buf.Grow(int(respLen))
-
-	_, err = buf.ReadFrom(&io.LimitedReader{R: in, N: int64(respLen)})
-	if err != nil {
-		workReq.RespChan <- workResponse{Err: fmt.Errorf("unable to read response")}
-		return
+		br = bare.NewReader(&buf)
+		// Because we are reading from a buffer, we ignore errors as there
+		// should be no failures.
+		//
+		// If the request comes out wonky, it because of a bug in the
+		// worker dispatcher writing corrupt responses, so they will
+		// just get a bogus response.
+
+		frameLen := uint32(buf.Len()) + 4
+		variant, _ = br.ReadUint()
+		if variant != 3 {
+			p.responseSizes.record(frameLen)
+			break
+		}
+		kind, _ := br.ReadString()
+		data, _ := br.ReadData()
+		// Never passed on, even when MaxRequestTimeout is not set.
+		if kind == "heartbeat" {
+			if timing.heartbeat != nil {
+				timing.heartbeat()
+			}
+			continue
+		}
+		onEvent(kind, data)
 	}
 
-	br := bare.NewReader(&buf)
-	// Because we are reading from a buffer, we ignore errors as there
-	// should be no failures.
-	//
-	// If the request comes out wonky, it because of a bug in the
-	// worker dispatcher writing corrupt responses, so they will
-	// just get a bogus response.
-
-	variant, _ := br.ReadUint()
 	switch variant {
 	case 0:
+		if mode == rawResponse {
+			payload := buf.Bytes()
+			status, recycle, err := scanRawHTTPResponse(payload)
+			if err != nil {
+				return HTTPResponse{}, nil, nil, false, err
+			}
+			if status < 100 || status > 999 {
+				return HTTPResponse{}, nil, nil, recycle, fmt.Errorf("%w: status %d", ErrInvalidResponse, status)
+			}
+			return HTTPResponse{}, payload, nil, recycle, nil
+		}
 		status, _ := br.ReadUint()
 		numHeaders, _ := br.ReadUint()
 		headers := make(map[string][]string)
@@ -251,19 +856,73 @@ func workerHandleRequest(ctx context.Context, p *WorkerPool, workReq workRequest
 		}
 
 		body, _ := br.ReadData()
+		// Workers predating recycle requests don't send this field.
+		recycle, _ := br.ReadBool()
+
+		// e.g. an empty response from a worker that didn't set a status,
+		// writing it would send a malformed status line.
+		if status < 100 || status > 999 {
+			return HTTPResponse{}, nil, nil, recycle, fmt.Errorf("%w: status %d", ErrInvalidResponse, status)
+		}
 
-		workReq.RespChan <- workResponse{Resp: HTTPResponse{
+		return HTTPResponse{
 			Status:  int(status),
 			Headers: headers,
 			Body:    body,
-		}}
+		}, nil, nil, recycle, nil
+	case 1:
+		msg, _ := br.ReadString()
+		return HTTPResponse{}, nil, nil, false, &HandlerError{Msg: msg}
 	default:
-		workReq.RespChan <- workResponse{Err: fmt.Errorf("worker sent unknown response variant")}
-		return
+		return HTTPResponse{}, nil, nil, false, fmt.Errorf("worker sent unknown response variant")
+	}
+}
+
+// scanRawHTTPResponse finds the status and recycle fields of an encoded
+// HTTPResponse without decoding the rest.
+func scanRawHTTPResponse(b []byte) (status uint64, recycle bool, err error) {
+	errCorrupt := errors.New("worker sent a corrupt response")
+	readUint := func() uint64 {
+		n, sz := binary.Uvarint(b)
+		if sz <= 0 {
+			err = errCorrupt
+			b = nil
+			return 0
+		}
+		b = b[sz:]
+		return n
+	}
+	skipData := func() {
+		n := readUint()
+		if n > uint64(len(b)) {
+			err = errCorrupt
+			b = nil
+			return
+		}
+		b = b[n:]
+	}
+	status = readUint()
+	numHeaders := readUint()
+	for i := uint64(0); i < numHeaders && err == nil; i++ {
+		skipData()
+		numValues := readUint()
+		for j := uint64(0); j < numValues && err == nil; j++ {
+			skipData()
+		}
+	}
+	skipData()
+	if err != nil {
+		return 0, false, err
 	}
+	// Workers predating recycle requests don't send this field.
+	recycle = len(b) != 0 && b[0] != 0
+	return status, recycle, nil
+}
 
-	ok = true
-	return
+// InFlight is the number of requests waiting for or being handled by a
+// worker.
+func (p *WorkerPool) InFlight() int64 {
+	return atomic.LoadInt64(&p.inFlight)
 }
 
 func (p *WorkerPool) NumWorkers() uint32 {
@@ -278,16 +937,29 @@ func (p *WorkerPool) RemoveWorker() {
 		return
 	}
 
-	p.cancelWorker[len(p.cancelWorker)-1]()
-	p.ctl = p.ctl[:len(p.ctl)-1]
-	p.cancelWorker = p.cancelWorker[:len(p.cancelWorker)-1]
+	last := len(p.cancelWorker) - 1
+	if p.cfg.RetireGrace > 0 {
+		// Let the worker finish its current request first, the
+		// cancellation only matters if it takes too long.
+		close(p.retireWorker[last])
+		time.AfterFunc(p.cfg.RetireGrace, p.cancelWorker[last])
+	} else {
+		p.cancelWorker[last]()
+	}
+	p.ctl = p.ctl[:last]
+	p.cancelWorker = p.cancelWorker[:last]
+	p.retireWorker = p.retireWorker[:last]
+	p.slotStats.Store(p.slotStatsSnapshot()[:last:last])
 	atomic.AddUint32(&p.numWorkers, ^uint32(0)) // Decrement
 }
 
 func (p *WorkerPool) SpawnWorker() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.spawnWorkerLocked()
+}
 
+func (p *WorkerPool) spawnWorkerLocked() {
 	if p.NumWorkers() >= p.cfg.MaxWorkers {
 		return
 	}
@@ -297,13 +969,52 @@ func (p *WorkerPool) SpawnWorker() {
 	ctl := make(chan ctlRequest)
 	p.ctl = append(p.ctl, ctl)
 	p.cancelWorker = append(p.cancelWorker, cancelWorker)
+	retiring := make(chan struct{})
+	p.retireWorker = append(p.retireWorker, retiring)
+	slotStats := &workerSlotStats{}
+	slots := p.slotStatsSnapshot()
+	p.slotStats.Store(append(slots[:len(slots):len(slots)], slotStats))
 	p.wg.Add(1)
 	atomic.AddUint32(&p.numWorkers, 1)
+	atomic.AddInt32(&p.runningWorkers, 1)
 
 	go func() {
 		defer p.wg.Done()
+		// A slot removed by reapIdleWorker is never cancelled otherwise.
+		defer cancelWorker()
+		defer func() {
+			atomic.AddInt32(&p.runningWorkers, -1)
+			p.notifyDrain()
+		}()
+
+		// Consecutive failures to start a worker for non transient reasons.
+		spawnFailures := 0
+		// Whether this slot counts towards failingWorkers.
+		failing := false
+		setFailing := func(isFailing bool) {
+			if failing != isFailing {
+				failing = isFailing
+				if isFailing {
+					atomic.AddInt32(&p.failingWorkers, 1)
+				} else {
+					atomic.AddInt32(&p.failingWorkers, -1)
+				}
+			}
+		}
+		defer setFailing(false)
 
 		for {
+			// Never relaunch a worker that was removed, retired or shut
+			// down while restarting, even when there is no restart delay.
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case <-retiring:
+				return
+			default:
+			}
+
 			var cmd *exec.Cmd
 			cmdWorkerWg := &sync.WaitGroup{}
 
@@ -311,17 +1022,78 @@ func (p *WorkerPool) SpawnWorker() {
 				if cmd != nil && cmd.Process != nil {
 					vpairs = append(vpairs, "worker-pid", cmd.Process.Pid)
 				}
-				p.cfg.Logfn(vpairs...)
+				p.log(vpairs...)
 			}
 
 			var workerProcessError error
+			// Set when the pipes could not be created or the worker could not be started.
+			var spawnErr error
+			// Set when the worker is stopped on purpose.
+			stopReason := ""
+			// Set when the worker is stopped over a failed request, which
+			// is then its LastError rather than the exit.
+			requestFailed := false
+
+			terminateMu := sync.Mutex{}
+			var terminatedAt time.Time
+			var killTimer *time.Timer
+			workerKilled := false
+
+			// terminate asks the worker process to exit, killing it if it
+			// is still running after WorkerShutdownTimeout.
+			terminate := func() {
+				terminateMu.Lock()
+				defer terminateMu.Unlock()
+				if !terminatedAt.IsZero() {
+					return
+				}
+				terminatedAt = time.Now()
+				_ = cmd.Process.Signal(syscall.SIGTERM)
+				if p.cfg.WorkerShutdownTimeout > 0 {
+					killTimer = time.AfterFunc(p.cfg.WorkerShutdownTimeout, func() {
+						terminateMu.Lock()
+						workerKilled = true
+						terminateMu.Unlock()
+						_ = cmd.Process.Kill()
+					})
+				}
+			}
+
+			// The request being handled, if any, so it still gets a
+			// response if we panic.
+			var pending *pendingWork
+
+			var recent *recentRequests
+			if p.cfg.CrashLogRequests > 0 {
+				recent = newRecentRequests(p.cfg.CrashLogRequests)
+			}
 
 			func() {
+				// A bug in the pool or one of its hooks must not take the
+				// whole process down, stop this worker and start another.
+				defer func() {
+					r := recover()
+					if r == nil {
+						return
+					}
+					stopReason = "panic"
+					kvs := []interface{}{"msg", "worker goroutine panicked", "panic", r, "stack", string(debug.Stack())}
+					if pending != nil {
+						kvs = append(kvs, "uri", pending.Req.Uri)
+						pending.answer(workResponse{Err: fmt.Errorf("worker goroutine panicked: %v", r)})
+						pending = nil
+					}
+					logfn(kvs...)
+					if cmd != nil && cmd.Process != nil {
+						terminate()
+					}
+				}()
 
 				perrmsg := "unable to create worker pipes"
 				p1, p2, err := os.Pipe()
 				if err != nil {
 					logfn("msg", perrmsg, "err", err)
+					spawnErr = err
 					return
 				}
 				defer p1.Close()
@@ -329,6 +1101,7 @@ func (p *WorkerPool) SpawnWorker() {
 				p3, p4, err := os.Pipe()
 				if err != nil {
 					logfn("msg", perrmsg, "err", err)
+					spawnErr = err
 					return
 				}
 				defer p3.Close()
@@ -337,11 +1110,24 @@ func (p *WorkerPool) SpawnWorker() {
 				p5, p6, err := os.Pipe()
 				if err != nil {
 					logfn("msg", perrmsg, "err", err)
+					spawnErr = err
 					return
 				}
 				defer p5.Close()
 				defer p6.Close()
 
+				if p.cfg.PipeBufferSize > 0 {
+					// Larger pipes mean fewer round trips for large messages,
+					// but the default size still works if the kernel refuses.
+					for _, f := range []*os.File{p2, p5} {
+						err := setPipeSize(f, p.cfg.PipeBufferSize)
+						if err != nil {
+							logfn("msg", "unable to set worker pipe buffer size", "err", err)
+							break
+						}
+					}
+				}
+
 				if len(p.cfg.WorkerProc) > 1 {
 					cmd = exec.Command(p.cfg.WorkerProc[0], p.cfg.WorkerProc[1:]...)
 				} else {
@@ -351,8 +1137,11 @@ func (p *WorkerPool) SpawnWorker() {
 				cmd.Stdin = p1
 				cmd.Stdout = p4
 				cmd.Stderr = p4
-				cmd.ExtraFiles = []*os.File{p6}
+				// fd 3 is the response pipe, any extra files follow from fd 4.
+				cmd.ExtraFiles = append([]*os.File{p6}, p.cfg.WorkerExtraFiles...)
 
+				// Receives the first FatalOutputPatterns match.
+				fatalOutput := make(chan []byte, 1)
 				cmdWorkerWg.Add(1)
 				go func() {
 					defer cmdWorkerWg.Done()
@@ -361,6 +1150,16 @@ func (p *WorkerPool) SpawnWorker() {
 						ln, err := brdr.ReadBytes('\n')
 						if len(ln) != 0 {
 							p.cfg.OnWorkerOutput(ln)
+						patterns:
+							for _, pattern := range p.cfg.FatalOutputPatterns {
+								if pattern.Match(ln) {
+									select {
+									case fatalOutput <- ln:
+									default:
+									}
+									break patterns
+								}
+							}
 						}
 						if err != nil {
 							return
@@ -380,16 +1179,35 @@ func (p *WorkerPool) SpawnWorker() {
 						// the current function returns.
 						_ = p2.Close()
 						_ = p5.Close()
+						select {
+						case <-retiring:
+							if p.workerCtx.Err() == nil {
+								logfn("msg", "removed worker overran its retire grace, killing it", "retire-grace", p.cfg.RetireGrace)
+								if p.cfg.OnWorkerEvent != nil {
+									p.cfg.OnWorkerEvent(HTTPRequest{}, "retire-killed", []byte(fmt.Sprintf("pid=%d", cmd.Process.Pid)))
+								}
+							}
+						default:
+						}
 					case <-cmdShuttingDown:
 					}
 				}()
 
+				execStart := time.Now()
 				err = cmd.Start()
 				if err != nil {
 					logfn("msg", "unable to spawn worker", "err", err)
+					spawnErr = err
 					return
 				}
 
+				if p.cfg.WorkerCoreDumps {
+					err := enableCoreDumps(cmd.Process.Pid)
+					if err != nil {
+						logfn("msg", "unable to enable worker core dumps", "err", err)
+					}
+				}
+
 				workerCmdDied := make(chan struct{})
 				cmdWorkerWg.Add(1)
 				go func() {
@@ -400,52 +1218,393 @@ func (p *WorkerPool) SpawnWorker() {
 
 				logfn("msg", "worker spawned")
 
+				// However we stop talking to the worker, it is never used
+				// again. A worker that closed its pipes but kept running
+				// would otherwise hold its slot until it exits by itself.
+				defer terminate()
+
 				// After the command has started, we need to close our side
 				// of the pipes we gave it.
 				_ = p1.Close()
 				_ = p4.Close()
 				_ = p6.Close()
 
-				workerHealthCheckTicker := time.NewTicker(p.cfg.WorkerHealthCheckInterval)
-				defer workerHealthCheckTicker.Stop()
-
-				for {
-					select {
-					case <-ctx.Done():
-						_ = cmd.Process.Signal(syscall.SIGTERM)
-						return
-					case <-workerCmdDied:
-						return
-					case ctlRequest := <-ctl:
-						respChan := ctlRequest.RespChan
-						switch req := ctlRequest.Req.(type) {
-						case restartWorkerProcRequest:
-							_ = cmd.Process.Signal(syscall.SIGTERM)
-							respChan <- struct{}{}
-							return
-						default:
-							respChan <- fmt.Errorf("unknown request type: %v", req)
-							return
-						}
-					case workReq := <-p.dispatch:
-						workerRequestTimeoutTimer := time.AfterFunc(p.cfg.WorkerRequestTimeout, func() {
-							logfn("msg", "janet worker request timed out, aborting request")
-							_ = cmd.Process.Signal(syscall.SIGTERM)
-						})
-						ok := workerHandleRequest(ctx, p, workReq, p2, p5)
-						timerStopped := workerRequestTimeoutTimer.Stop()
-						if !ok || !timerStopped {
-							logfn("msg", "worker restarting due to error")
-							return
+				handshakeTimer := time.AfterFunc(p.cfg.WorkerHandshakeTimeout, func() {
+					logfn("msg", "worker handshake timed out")
+					terminate()
+					_ = p2.Close()
+					_ = p5.Close()
+				})
+				err = workerHandshake(p, p2, p5)
+				if !handshakeTimer.Stop() && err == nil {
+					// Finished just as the timer fired, which has
+					// already stopped the worker.
+					err = errors.New("worker handshake timed out")
+				}
+				if err != nil {
+					if ctx.Err() == nil {
+						logfn("msg", "worker handshake failed", "err", err)
+						if errors.Is(err, errProtocolMismatch) && p.cfg.OnWorkerEvent != nil {
+							p.cfg.OnWorkerEvent(HTTPRequest{}, "protocol-mismatch", []byte(err.Error()))
 						}
-					case <-workerHealthCheckTicker.C:
-						// size=1 ++ variant=1.
-						healthCheckRequest := []byte{1, 0, 0, 0, 1}
-						_, err = p2.Write(healthCheckRequest)
-						if err != nil {
+					}
+					terminate()
+					return
+				}
+				spawnDuration := time.Since(execStart)
+
+				// The worker only takes requests once it has answered these,
+				// their responses are thrown away.
+				warmupStart := time.Now()
+				for _, req := range p.cfg.WarmupRequests {
+					warmupTimer := time.AfterFunc(p.cfg.WorkerRequestTimeout, func() {
+						logfn("msg", "worker warmup request timed out")
+						terminate()
+						_ = p2.Close()
+						_ = p5.Close()
+					})
+					timing := &requestTiming{start: time.Now()}
+					_, _, _, _, err = workerHandleRequest(ctx, p, req, p2, p5, timing, decodeResponse, nil, func(kind string, data []byte) {})
+					if !warmupTimer.Stop() && err == nil {
+						err = ErrWorkerTimeout
+					}
+					var handlerErr *HandlerError
+					if err != nil && !errors.As(err, &handlerErr) && !errors.Is(err, ErrInvalidResponse) {
+						if ctx.Err() == nil {
+							logfn("msg", "worker warmup request failed", "uri", req.Uri, "err", err)
+						}
+						terminate()
+						return
+					}
+				}
+				warmupDuration := time.Since(warmupStart)
+
+				p.spawnDurations.record(spawnDuration)
+				if len(p.cfg.WarmupRequests) != 0 {
+					p.warmupDurations.record(warmupDuration)
+				}
+				if p.cfg.OnWorkerEvent != nil {
+					p.cfg.OnWorkerEvent(HTTPRequest{}, "worker-ready", []byte(fmt.Sprintf("pid=%d spawn=%s warmup=%s", cmd.Process.Pid, spawnDuration, warmupDuration)))
+				}
+				atomic.StoreInt32(&p.ready, 1)
+				setFailing(false)
+
+				live := &liveWorker{
+					pid:      cmd.Process.Pid,
+					recycle:  make(chan string, 1),
+					lastUsed: time.Now().UnixNano(),
+					retiring: retiring,
+				}
+				p.addLiveWorker(live)
+				defer p.removeLiveWorker(live)
+				slotStats.setPid(live.pid)
+				defer slotStats.setPid(0)
+
+				// Each check is WorkerHealthCheckInterval plus or minus a random
+				// WorkerHealthCheckJitter fraction of it after the last, so the
+				// workers of a pool don't all check in lockstep.
+				healthCheckDelay := func() time.Duration {
+					d := p.cfg.WorkerHealthCheckInterval
+					return d + time.Duration((rand.Float64()*2-1)*p.cfg.WorkerHealthCheckJitter*float64(d))
+				}
+				workerHealthCheckTimer := time.NewTimer(healthCheckDelay())
+				defer workerHealthCheckTimer.Stop()
+
+				// retire stops a healthy worker that is being replaced, first
+				// giving it a chance to save its state if configured.
+				retire := func(reason string) {
+					stopReason = reason
+					if p.cfg.WorkerPrepareRecycleTimeout > 0 {
+						prepareTimer := time.AfterFunc(p.cfg.WorkerPrepareRecycleTimeout, func() {
+							_ = p2.Close()
+							_ = p5.Close()
+						})
+						err := workerPrepareRecycle(p, p2, p5)
+						if !prepareTimer.Stop() {
+							err = errors.New("timed out")
+						}
+						if err != nil {
+							logfn("msg", "worker did not acknowledge recycle", "err", err)
+						}
+					}
+					terminate()
+				}
+
+				// handleWork sends a request to the worker and delivers the
+				// outcome, it returns false if the worker must be stopped.
+				handleWork := func(workReq workRequest) bool {
+					p.addActive(1)
+					defer p.addActive(-1)
+					atomic.StoreInt64(&live.lastUsed, 0)
+					defer func() {
+						atomic.StoreInt64(&live.lastUsed, time.Now().UnixNano())
+					}()
+					logfn := p.requestLogfn(logfn, workReq.Req)
+					requestTimeout := p.cfg.WorkerRequestTimeout
+					// Also read by abort from the timer goroutine.
+					var timeoutErr atomic.Value
+					timeoutErr.Store(ErrWorkerTimeout)
+					if !workReq.Deadline.IsZero() {
+						remaining := time.Until(workReq.Deadline)
+						if remaining <= 0 {
+							// Not worth restarting the worker over.
+							workReq.RespChan <- workResponse{Err: ErrExecTimeout}
+							return true
+						}
+						if remaining < requestTimeout {
+							requestTimeout = remaining
+							timeoutErr.Store(ErrExecTimeout)
+						}
+					}
+					work := &pendingWork{workRequest: workReq}
+					pending = work
+					timing := &requestTiming{start: time.Now()}
+					// 1 once the request timed out or was cancelled, 2 once
+					// it was handled in time.
+					aborted := int32(0)
+					stopWorker := func() {
+						terminate()
+						// Unblock a read or write in progress even if the
+						// worker ignores SIGTERM, closing is safe while they
+						// run. The worker is never reused after this.
+						_ = p2.Close()
+						_ = p5.Close()
+					}
+					abort := func() {
+						if !atomic.CompareAndSwapInt32(&aborted, 0, 1) {
+							return
+						}
+						// Answer now rather than once the worker goroutine
+						// notices the closed pipes.
+						work.answer(workResponse{Err: fmt.Errorf("%w %s", timeoutErr.Load().(error), timing)})
+						writeTime, readTime, writing := timing.phases()
+						phase := "read"
+						if writing {
+							phase = "write"
+						}
+						logfn("msg", "janet worker request timed out, aborting request", "phase", phase, "write-time", writeTime, "read-time", readTime)
+						stopWorker()
+					}
+					if workReq.Inflight != nil {
+						cancel := func() {
+							if !atomic.CompareAndSwapInt32(&aborted, 0, 1) {
+								return
+							}
+							work.answer(workResponse{Err: ErrRequestCancelled})
+							logfn("msg", "request cancelled, stopping worker")
+							stopWorker()
+						}
+						if !workReq.Inflight.handle(cmd.Process.Pid, cancel) {
+							pending = nil
+							work.answer(workResponse{Err: ErrRequestCancelled})
+							return true
+						}
+						defer workReq.Inflight.handled()
+					}
+					workerRequestTimeoutTimer := time.AfterFunc(requestTimeout, abort)
+					if p.cfg.MaxRequestTimeout > 0 {
+						hardDeadline := timing.start.Add(p.cfg.MaxRequestTimeout)
+						timing.heartbeat = func() {
+							d := p.cfg.WorkerRequestTimeout
+							if remaining := time.Until(hardDeadline); remaining < d {
+								d = remaining
+							}
+							if !workReq.Deadline.IsZero() {
+								if remaining := time.Until(workReq.Deadline); remaining < d {
+									d = remaining
+									timeoutErr.Store(ErrExecTimeout)
+								}
+							}
+							if d > 0 && workerRequestTimeoutTimer.Stop() {
+								workerRequestTimeoutTimer.Reset(d)
+							}
+						}
+					}
+					if p.cfg.WorkerWriteTimeout > 0 && p.cfg.WorkerWriteTimeout < requestTimeout {
+						// Catches a worker that stopped reading its stdin
+						// before it uses up the whole request timeout.
+						workerWriteTimeoutTimer := time.AfterFunc(p.cfg.WorkerWriteTimeout, func() {
+							if _, _, writing := timing.phases(); writing {
+								abort()
+							}
+						})
+						defer workerWriteTimeoutTimer.Stop()
+					}
+					if p.cfg.MaxWorkerCPUTime > 0 {
+						err := limitCPUTime(cmd.Process.Pid, p.cfg.MaxWorkerCPUTime)
+						if err != nil {
+							logfn("msg", "unable to limit worker cpu time", "err", err)
+						}
+					}
+					var logs []byte
+					onEvent := func(kind string, data []byte) {
+						if kind == "log" && workReq.CollectLogs {
+							logs = appendRequestLog(logs, data, p.cfg.RequestLogLimit)
+						}
+						if p.cfg.OnWorkerEvent != nil {
+							p.cfg.OnWorkerEvent(workReq.Req, kind, data)
+						}
+					}
+					resp, rawResp, spilled, recycle, err := workerHandleRequest(ctx, p, workReq.Req, p2, p5, timing, workReq.Mode, workReq.Stream, onEvent)
+					workerRequestTimeoutTimer.Stop()
+					if p.usage != nil {
+						p.usage.add(p.cfg.UsageTag(workReq.Req), time.Since(timing.start))
+					}
+					live.recordLatency(time.Since(timing.start))
+					if recent != nil {
+						r := recentRequest{
+							at:       timing.start,
+							method:   workReq.Req.Method,
+							uri:      workReq.Req.Uri,
+							duration: time.Since(timing.start),
+							err:      err,
+						}
+						if p.cfg.LogFields != nil {
+							r.fields = p.cfg.LogFields(workReq.Req)
+						}
+						recent.add(r)
+					}
+					// Claimed, so a timeout or cancellation arriving now
+					// leaves the worker alone.
+					timerStopped := atomic.CompareAndSwapInt32(&aborted, 0, 2)
+					if !timerStopped {
+						// The caller already has its timeout or cancellation
+						// error, whatever the worker managed to send is not
+						// wanted.
+						if spilled != nil {
+							_ = spilled.Close()
+						}
+						resp, rawResp, spilled, err = HTTPResponse{}, nil, nil, ErrWorkerTimeout
+					}
+					slotStats.recordRequest(err, p.cfg.LastErrorClearAfter)
+					// RespChan is buffered and answered once, so the caller
+					// always gets exactly one outcome without the worker
+					// ever blocking.
+					work.answer(workResponse{Resp: resp, Raw: rawResp, Spilled: spilled, Logs: logs, Err: err})
+					pending = nil
+					var handlerErr *HandlerError
+					if errors.Is(err, ErrInvalidResponse) {
+						logfn("msg", "worker sent an invalid response", "err", err)
+						if p.cfg.RecycleOnInvalidResponse {
+							retire("invalid response")
+							return false
+						}
+					} else if (err != nil && !errors.As(err, &handlerErr)) || !timerStopped {
+						requestFailed = true
+						logfn("msg", "worker restarting due to error")
+						return false
+					}
+					if recycle {
+						retire("worker requested recycle")
+						return false
+					}
+					return true
+				}
+
+				// The worker counts as idle for Ready while it waits for work.
+				idle := false
+				setIdle := func(isIdle bool) {
+					if idle != isIdle {
+						idle = isIdle
+						p.addIdleWorkers(isIdle)
+					}
+				}
+				defer setIdle(false)
+
+				for {
+					dispatch, pauseChanged := p.workerDispatchChan()
+					select {
+					case <-retiring:
+						// Removed, so take no more requests.
+						dispatch = nil
+					default:
+					}
+					setIdle(dispatch != nil)
+					select {
+					case <-ctx.Done():
+						terminate()
+						return
+					case <-retiring:
+						retire("removed")
+						return
+					case <-pauseChanged:
+					case <-workerCmdDied:
+						return
+					case ctlRequest := <-ctl:
+						setIdle(false)
+						respChan := ctlRequest.RespChan
+						switch req := ctlRequest.Req.(type) {
+						case restartWorkerProcRequest:
+							retire("restart requested")
+							respChan <- struct{}{}
+							return
+						case broadcastRequest:
+							workReq := workRequest{
+								Req:      req.req,
+								RespChan: make(chan workResponse, 1),
+							}
+							ok := handleWork(workReq)
+							respChan <- (<-workReq.RespChan).Err
+							if !ok {
+								return
+							}
+						case directRequest:
+							workReq := workRequest{
+								Req:      req.req,
+								RespChan: make(chan workResponse, 1),
+							}
+							ok := handleWork(workReq)
+							respChan <- <-workReq.RespChan
+							if !ok {
+								return
+							}
+						case quiesceWorkerRequest:
+							atomic.StoreInt64(&live.lastUsed, 0)
+							respChan <- cmd.Process.Pid
+							logfn("msg", "worker quiesced", "duration", req.d)
+							quiesceTimer := time.NewTimer(req.d)
+							select {
+							case <-ctx.Done():
+								quiesceTimer.Stop()
+								terminate()
+								return
+							case <-workerCmdDied:
+								quiesceTimer.Stop()
+								return
+							case <-req.release:
+								quiesceTimer.Stop()
+							case <-quiesceTimer.C:
+							}
+							atomic.StoreInt64(&live.lastUsed, time.Now().UnixNano())
+							logfn("msg", "worker returned to rotation")
+						default:
+							respChan <- fmt.Errorf("unknown request type: %v", req)
+							return
+						}
+					case reason := <-live.recycle:
+						retire(reason)
+						return
+					case ln := <-fatalOutput:
+						logfn("msg", "worker printed a fatal warning, recycling", "output", ln)
+						if p.cfg.OnWorkerEvent != nil {
+							p.cfg.OnWorkerEvent(HTTPRequest{}, "fatal-output", ln)
+						}
+						retire("fatal output")
+						return
+					case workReq := <-dispatch:
+						setIdle(false)
+						if !handleWork(workReq) {
+							return
+						}
+					case <-workerHealthCheckTimer.C:
+						// size=1 ++ variant=1.
+						healthCheckRequest := []byte{1, 0, 0, 0, 1}
+						_, err = p2.Write(healthCheckRequest)
+						if err != nil {
 							logfn("msg", "worker restarting, error requesting health check")
 							return
 						}
+						workerHealthCheckTimer.Reset(healthCheckDelay())
 					}
 				}
 
@@ -453,15 +1612,86 @@ func (p *WorkerPool) SpawnWorker() {
 
 			cmdWorkerWg.Wait()
 
-			if ctx.Err() == nil {
-				logfn("msg", "pool worker died", "err", workerProcessError)
+			terminateMu.Lock()
+			if killTimer != nil {
+				killTimer.Stop()
+			}
+			killed := workerKilled
+			exitTime := time.Since(terminatedAt)
+			terminateMu.Unlock()
+
+			if killed {
+				logfn("msg", "worker killed after shutdown timeout")
+			}
+			if p.cfg.WorkerCoreDumps && workerDumpedCore(workerProcessError) {
+				logfn("msg", "worker dumped core", "core-path", corePath(cmd.Process.Pid))
+			}
+			if p.workerCtx.Err() != nil && cmd != nil && cmd.Process != nil {
+				p.recordWorkerShutdown(exitTime, killed)
+			}
+
+			if spawnErr != nil || (stopReason == "" && ctx.Err() == nil) {
+				setFailing(true)
+			}
+			if recent != nil && spawnErr == nil && stopReason == "" && ctx.Err() == nil {
+				recent.dump(logfn)
+			}
+			if spawnErr != nil {
+				slotStats.recordError(fmt.Sprintf("worker failed to start: %s", spawnErr))
+			} else if stopReason == "" && ctx.Err() == nil && !requestFailed {
+				slotStats.recordError(fmt.Sprintf("worker died: %v", workerProcessError))
+			}
+
+			restartDelay := p.cfg.WorkerRestartDelay
+			if spawnErr != nil {
+				if isTransientSpawnError(spawnErr) {
+					if restartDelay > transientSpawnRetryDelay {
+						restartDelay = transientSpawnRetryDelay
+					}
+				} else {
+					// Back off exponentially so a broken WorkerProc doesn't
+					// flood the logs.
+					spawnFailures += 1
+					if restartDelay < transientSpawnRetryDelay {
+						restartDelay = transientSpawnRetryDelay
+					}
+					for i := 1; i < spawnFailures && restartDelay < maxSpawnRetryDelay; i++ {
+						restartDelay *= 2
+					}
+					if restartDelay > maxSpawnRetryDelay {
+						restartDelay = maxSpawnRetryDelay
+					}
+					logfn("msg", "worker failing to start", "failures", spawnFailures, "retry-in", restartDelay)
+				}
 			} else {
-				logfn("msg", "worker shutdown by request")
+				spawnFailures = 0
+				if stopReason != "" {
+					logfn("msg", "worker stopped", "reason", stopReason)
+				} else if ctx.Err() == nil {
+					logfn("msg", "pool worker died", "err", workerProcessError)
+				} else {
+					logfn("msg", "worker shutdown by request")
+				}
+			}
+			if p.cfg.MaxRestartsPerWindow > 0 && (spawnErr != nil || (stopReason == "" && ctx.Err() == nil)) {
+				tripped, reset := p.recordRestart()
+				if tripped && p.cfg.StopRestartsOnTrip {
+					logfn("msg", "worker not restarting until the restart guard is reset")
+					select {
+					case <-ctx.Done():
+						return
+					case <-retiring:
+						return
+					case <-reset:
+					}
+				}
 			}
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(p.cfg.WorkerRestartDelay):
+			case <-retiring:
+				return
+			case <-time.After(restartDelay):
 				atomic.AddUint64(&p.workerRestarts, 1)
 			}
 		}
@@ -469,59 +1699,391 @@ func (p *WorkerPool) SpawnWorker() {
 	}()
 }
 
+// Dispatch sends a request to a worker and waits for the response.
+//
+// If SampleRate is N, OnSample is called with one in N requests and
+// their outcome. It is called from the dispatching goroutine, so it must
+// copy anything it wants to keep beyond the call.
+//
+// If Dispatch would return an error and Fallback is set, Fallback may
+// supply a response to return instead by returning true.
+//
+// If IdempotencyWindow is set, requests with the same method, uri and
+// IdempotencyKeyHeader value (Idempotency-Key by default) as an earlier
+// request are not dispatched again. While the first request is in
+// progress duplicates wait for it and get the same outcome, once it has
+// succeeded its response is returned for duplicates arriving within the
+// window. Failed requests are not remembered so clients may retry them,
+// this means a handler may run again after failing part way through.
+// Responses shared this way must not be modified by the caller.
+//
+// If ShadowPool is set, a ShadowRate fraction of requests is dispatched
+// again to ShadowPool after the primary response is ready, and OnShadow
+// is called with both outcomes from a separate goroutine. The shadow
+// request never delays or changes the primary response, the caller must
+// not modify the primary response for the same reason.
+//
+// If SequenceKey is set, requests for which it returns the same non empty
+// key are handled one at a time in the order Dispatch was called, so a
+// stateful worker sees them in order even across retries and restarts.
+// A request waits for all earlier requests with its key to complete
+// before it starts waiting for a worker, the time spent queued this way
+// is not limited by WorkerRendezvousTimeout.
+//
+// Middleware added with Use runs before all of the above.
+//
+// If RequestValidator is set and returns an error for req, Dispatch fails
+// straight away with ErrInvalidRequest wrapping it. Validation runs before
+// the request waits for its SequenceKey or goes through admission
+// control, so invalid requests use up no queue or rate limit budget.
 func (p *WorkerPool) Dispatch(req HTTPRequest) (HTTPResponse, error) {
+	if h, ok := p.dispatchChain.Load().(DispatchFunc); ok {
+		return h(req)
+	}
+	return p.dispatchWithHooks(req)
+}
 
-	atomic.StoreInt32(&p.attritionMarker, 0)
+func (p *WorkerPool) dispatchWithHooks(req HTTPRequest) (HTTPResponse, error) {
+	if err := p.validateRequest(req); err != nil {
+		return HTTPResponse{}, err
+	}
 
-	respChan := make(chan workResponse, 1)
+	if p.sequencer != nil {
+		if key := p.cfg.SequenceKey(req); key != "" {
+			defer p.sequencer.acquire(key)()
+		}
+	}
 
-	workReq := workRequest{
-		Req:      req,
-		RespChan: respChan,
+	var resp HTTPResponse
+	var err error
+	if key := req.Headers[p.cfg.IdempotencyKeyHeader]; p.idempotency != nil && key != "" {
+		resp, err = p.idempotency.do(req.Method+" "+req.Uri+" "+key, func() (HTTPResponse, error) {
+			return p.doDispatch(req)
+		})
+	} else {
+		resp, err = p.doDispatch(req)
+	}
+	if p.cfg.SampleRate != 0 {
+		if atomic.AddUint64(&p.sampleCounter, 1)%p.cfg.SampleRate == 0 {
+			p.cfg.OnSample(req, resp, err)
+		}
+	}
+	if p.cfg.ShadowPool != nil && rand.Float64() < p.cfg.ShadowRate {
+		p.shadow(req, resp, err)
+	}
+	if err != nil && p.cfg.Fallback != nil {
+		if fallbackResp, ok := p.cfg.Fallback(req, err); ok {
+			return fallbackResp, nil
+		}
 	}
+	return resp, err
+}
 
-	t := time.NewTimer(p.cfg.WorkerSpawnTimeout)
-	select {
-	case <-t.C:
+func (p *WorkerPool) shadow(req HTTPRequest, resp HTTPResponse, err error) {
+	// The caller may reuse the request once Dispatch returns.
+	headers := make(map[string]string, len(req.Headers))
+	for k, v := range req.Headers {
+		headers[k] = v
+	}
+	req.Headers = headers
+	req.Body = append([]byte{}, req.Body...)
+	go func() {
+		shadowResp, shadowErr := p.cfg.ShadowPool.Dispatch(req)
+		p.cfg.OnShadow(req, resp, err, shadowResp, shadowErr)
+	}()
+}
+
+// DispatchCallback is like Dispatch but returns straight away, calling
+// cb exactly once with the outcome from a goroutine of its own. If the
+// pool is closed cb is called with ErrWorkerPoolClosed.
+func (p *WorkerPool) DispatchCallback(req HTTPRequest, cb func(HTTPResponse, error)) {
+	go func() {
+		cb(p.Dispatch(req))
+	}()
+}
+
+func (p *WorkerPool) validateRequest(req HTTPRequest) error {
+	if p.cfg.RequestValidator == nil {
+		return nil
+	}
+	if err := p.cfg.RequestValidator(req); err != nil {
+		return invalidRequestError{err: err}
+	}
+	return nil
+}
+
+// invalidRequestError is ErrInvalidRequest while still unwrapping to the
+// validator's own error.
+type invalidRequestError struct {
+	err error
+}
+
+func (e invalidRequestError) Error() string {
+	return ErrInvalidRequest.Error() + ": " + e.err.Error()
+}
+
+func (e invalidRequestError) Is(target error) bool {
+	return target == ErrInvalidRequest
+}
+
+func (e invalidRequestError) Unwrap() error {
+	return e.err
+}
+
+// doDispatch enforces TotalTimeout across both waiting for a worker,
+// failing with ErrQueueTimeout, and handling the request, where the
+// worker is given only the remaining time and fails with ErrExecTimeout.
+func (p *WorkerPool) doDispatch(req HTTPRequest) (HTTPResponse, error) {
+	r, err := p.dispatchWork(workRequest{Req: req})
+	return r.Resp, err
+}
+
+// DispatchRawResponse is like Dispatch but returns the worker's response
+// undecoded, for a proxy that forwards it elsewhere without inspecting
+// it. The bytes are the BARE encoding of an HTTPResponse as described in
+// the README: status, headers, body and recycle, without the variant tag
+// or length prefix, to be decoded by whoever receives them. Handler
+// errors, invalid statuses and recycle requests are handled as they are
+// by Dispatch, and so is RequestValidator. Middleware, SequenceKey,
+// idempotency, sampling, shadowing and the Fallback pool are not applied.
+func (p *WorkerPool) DispatchRawResponse(req HTTPRequest) ([]byte, error) {
+	if err := p.validateRequest(req); err != nil {
+		return nil, err
+	}
+	r, err := p.dispatchWork(workRequest{Req: req, Mode: rawResponse})
+	return r.Raw, err
+}
+
+var respChanPool = sync.Pool{
+	New: func() interface{} {
+		return make(chan workResponse, 1)
+	},
+}
+
+var timerPool sync.Pool
+
+// getTimer is like time.NewTimer but reuses timers returned by putTimer.
+func getTimer(d time.Duration) *time.Timer {
+	if t, ok := timerPool.Get().(*time.Timer); ok {
+		t.Reset(d)
+		return t
+	}
+	return time.NewTimer(d)
+}
+
+func putTimer(t *time.Timer) {
+	if !t.Stop() {
+		// Don't let the next user see a stale expiry.
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	timerPool.Put(t)
+}
+
+// admit asks the Admission controller to admit workReq, giving up on a
+// wait for it like the queue would.
+func (p *WorkerPool) admit(workReq workRequest, deadline time.Time) (func(), error) {
+	waiter, ok := p.cfg.Admission.(admitWaiter)
+	if !ok {
+		return p.cfg.Admission.Admit(workReq.Req)
+	}
+	ctx := context.Background()
+	if workReq.Stream != nil {
+		ctx = workReq.Stream.ctx
+	}
+	if !deadline.IsZero() {
+		var cancel func()
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	release, err := waiter.admitWait(ctx, p.workerCtx.Done(), workReq.Req)
+	if err != nil && ctx.Err() != nil {
+		if workReq.Stream != nil && workReq.Stream.ctx.Err() != nil {
+			return nil, workReq.Stream.ctx.Err()
+		}
+		return nil, ErrQueueTimeout
+	}
+	return release, err
+}
 
-		// Only bother grabbing the mutex if we know it has a chance
-		// of spawning a new worker (NumWorkers does not lock).
-		if p.NumWorkers() < p.cfg.MaxWorkers {
-			p.SpawnWorker()
+// dispatchWork hands workReq to a worker, filling in its RespChan and
+// Deadline.
+func (p *WorkerPool) dispatchWork(workReq workRequest) (workResponse, error) {
+	req := workReq.Req
+	atomic.AddUint64(&p.requests, 1)
+	start := time.Now()
+
+	var deadline time.Time
+	var deadlineC <-chan time.Time
+	if p.cfg.TotalTimeout > 0 {
+		deadline = time.Now().Add(p.cfg.TotalTimeout)
+		deadlineTimer := getTimer(p.cfg.TotalTimeout)
+		defer putTimer(deadlineTimer)
+		deadlineC = deadlineTimer.C
+	}
+	// Only until a worker takes the request, see DispatchTo.
+	var ctxDone <-chan struct{}
+	if workReq.Stream != nil {
+		ctxDone = workReq.Stream.ctx.Done()
+	}
+
+	if p.cfg.Admission != nil {
+		release, err := p.admit(workReq, deadline)
+		if err != nil {
+			if err == ErrRateLimited {
+				atomic.AddUint64(&p.rateLimited, 1)
+			}
+			return workResponse{}, err
+		}
+		defer release()
+	}
+
+	atomic.AddInt64(&p.inFlight, 1)
+	p.addActive(1)
+	defer func() {
+		atomic.AddInt64(&p.inFlight, -1)
+		p.addActive(-1)
+		p.notifyDrain()
+	}()
+
+	if atomic.LoadInt32(&p.draining) != 0 {
+		return workResponse{}, ErrWorkerPoolClosed
+	}
+
+	if p.cfg.RejectWhenPaused && p.Paused() {
+		return workResponse{}, ErrWorkerPoolPaused
+	}
+
+	// Until the first worker has started, requests can only time out.
+	if p.cfg.RejectUntilReady && atomic.LoadInt32(&p.ready) == 0 {
+		return workResponse{}, ErrPoolNotReady
+	}
+
+	// Workers that are only restarting will be back soon, crashed ones
+	// may never be.
+	if p.cfg.FailFastWithoutWorkers && atomic.LoadInt32(&p.numLive) == 0 && atomic.LoadInt32(&p.failingWorkers) != 0 {
+		return workResponse{}, ErrNoHealthyWorkers
+	}
+
+	atomic.StoreInt32(&p.attritionMarker, 0)
+
+	respChan := respChanPool.Get().(chan workResponse)
+	// Only safe to reuse once we know nothing will be sent on it later,
+	// either it was never handed to a worker or its response was taken.
+	reuseRespChan := true
+	defer func() {
+		if reuseRespChan {
+			respChanPool.Put(respChan)
 		}
-		t.Reset(p.cfg.WorkerRendezvousTimeout)
+	}()
+
+	workReq.RespChan = respChan
+	workReq.Deadline = deadline
+	workReq.Inflight = p.registerInflight(req)
+	defer p.unregisterInflight(workReq.Inflight)
+	if workReq.Stream != nil {
+		workReq.Stream.setInflight(workReq.Inflight)
+	}
+
+	// With FIFODispatch only the request at the head of the queue offers
+	// itself to the workers, the rest wait for their turn.
+	dispatch := p.dispatch
+	var turn <-chan struct{}
+	var fifoPlace *fifoWaiter
+	if p.fifo != nil {
+		fifoPlace = p.fifo.enter()
+		defer p.fifo.leave(fifoPlace)
+		dispatch, turn = nil, fifoPlace.ready
+	}
+
+	t := getTimer(p.cfg.WorkerSpawnTimeout)
+	defer putTimer(t)
+	spawnTimedOut := false
+	for dispatched := false; !dispatched; {
 		select {
+		case <-turn:
+			dispatch, turn = p.dispatch, nil
 		case <-t.C:
-			return HTTPResponse{}, ErrWorkerPoolBusy
+			if spawnTimedOut {
+				if p.Paused() {
+					return workResponse{}, ErrWorkerPoolPaused
+				}
+				return workResponse{}, ErrWorkerPoolBusy
+			}
+			spawnTimedOut = true
+			// Only bother grabbing the mutex if we know it has a chance
+			// of spawning a new worker (NumWorkers does not lock).
+			// There is no point spawning workers while paused.
+			if p.NumWorkers() < p.cfg.MaxWorkers && !p.Paused() {
+				p.SpawnWorker()
+			}
+			t.Reset(p.cfg.WorkerRendezvousTimeout)
+		case <-deadlineC:
+			return workResponse{}, ErrQueueTimeout
+		case <-ctxDone:
+			return workResponse{}, workReq.Stream.ctx.Err()
+		case <-workReq.Inflight.cancelled:
+			return workResponse{}, ErrRequestCancelled
 		case <-p.workerCtx.Done():
-			t.Stop()
-			return HTTPResponse{}, ErrWorkerPoolClosed
-		case p.dispatch <- workReq:
-			t.Stop()
+			return workResponse{}, ErrWorkerPoolClosed
+		case dispatch <- workReq:
+			dispatched = true
 		}
-	case <-p.workerCtx.Done():
-		t.Stop()
-		return HTTPResponse{}, ErrWorkerPoolClosed
-	case p.dispatch <- workReq:
-		t.Stop()
+	}
+	if fifoPlace != nil {
+		// Let the next request go while we wait for our response.
+		p.fifo.leave(fifoPlace)
 	}
 
 	select {
 	case <-p.workerCtx.Done():
-		return HTTPResponse{}, ErrWorkerPoolClosed
+		// The worker may still send its response.
+		reuseRespChan = false
+		return workResponse{}, ErrWorkerPoolClosed
 	case r := <-workReq.RespChan:
+		p.latency.record(time.Since(start))
 		if r.Err != nil {
-			return HTTPResponse{}, fmt.Errorf("request failed: %w", r.Err)
+			return workResponse{Logs: r.Logs}, fmt.Errorf("request failed: %w", r.Err)
 		}
-		return r.Resp, nil
+		return r, nil
 	}
 }
 
+// RestartWorkers replaces every worker, one at a time.
+//
+// With WarmRestarts, a worker is only restarted once the replacements of
+// those restarted before it have finished starting, and RestartWorkers
+// returns once the last replacement has, so there are never fewer
+// started workers than before minus one. If there is only one worker an
+// extra one is started first when MaxWorkers allows, so there is always
+// a started worker, the extra one is culled later by attrition. If the
+// replacements keep failing to start RestartWorkers waits until ctx is
+// done rather than restart the remaining workers.
 func (p *WorkerPool) RestartWorkers(ctx context.Context) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	for i := uint32(0); i < p.NumWorkers(); i++ {
+	var old map[*liveWorker]struct{}
+	replaced := 0
+	if p.cfg.WarmRestarts {
+		old = p.liveWorkerSet()
+		if p.NumWorkers() == 1 && p.NumWorkers() < p.cfg.MaxWorkers {
+			p.spawnWorkerLocked()
+			replaced = 1
+		}
+	}
+
+	n := p.NumWorkers() - uint32(replaced)
+	for i := uint32(0); i < n; i++ {
+		if p.cfg.WarmRestarts {
+			err := p.waitNewLiveWorkers(ctx, old, replaced)
+			if err != nil {
+				return err
+			}
+			replaced += 1
+		}
 		respChan := make(chan interface{}, 1)
 		select {
 		case <-ctx.Done():
@@ -539,20 +2101,343 @@ func (p *WorkerPool) RestartWorkers(ctx context.Context) error {
 		}
 	}
 
+	if p.cfg.WarmRestarts {
+		return p.waitNewLiveWorkers(ctx, old, replaced)
+	}
 	return nil
 }
 
-func (p *WorkerPool) Close() {
+// Broadcast sends req to every worker once, waiting for each worker to
+// finish its current request first, and returns each worker's error in
+// worker id order. A worker that is restarting when the broadcast
+// starts receives it once its replacement process has started. Like
+// RestartWorkers it prevents workers being added or removed until it
+// is done.
+func (p *WorkerPool) Broadcast(ctx context.Context, req HTTPRequest) []error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	errs := make([]error, len(p.ctl))
+	wg := sync.WaitGroup{}
+	for i, ctl := range p.ctl {
+		i, ctl := i, ctl
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			respChan := make(chan interface{}, 1)
+			select {
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			case <-p.workerCtx.Done():
+				errs[i] = ErrWorkerPoolClosed
+				return
+			case ctl <- ctlRequest{
+				Req:      broadcastRequest{req: req},
+				RespChan: respChan,
+			}:
+			}
+			select {
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+			case <-p.workerCtx.Done():
+				errs[i] = ErrWorkerPoolClosed
+			case r := <-respChan:
+				if r != nil {
+					errs[i] = fmt.Errorf("request failed: %w", r.(error))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func (p *WorkerPool) addIdleWorkers(idle bool) {
+	p.idleMu.Lock()
+	defer p.idleMu.Unlock()
+	if idle {
+		p.idle.idleWorkers += 1
+		if p.idle.idleWorkers == 1 && !p.idle.closed {
+			close(p.idle.ch)
+		}
+	} else {
+		p.idle.idleWorkers -= 1
+		if p.idle.idleWorkers == 0 && !p.idle.closed {
+			p.idle.ch = make(chan struct{})
+		}
+	}
+}
+
+// Ready returns a channel that is closed while at least one worker is
+// idle, so a Dispatch right away is unlikely to wait. Once all
+// workers are busy, later calls return a new channel that is closed
+// when one becomes idle. Call Ready again after each Dispatch rather
+// than reusing the channel. Once the pool is closed the returned channel
+// is always closed, and Dispatch fails with ErrWorkerPoolClosed.
+func (p *WorkerPool) Ready() <-chan struct{} {
+	p.idleMu.Lock()
+	defer p.idleMu.Unlock()
+	return p.idle.ch
+}
+
+// QuiesceWorker takes worker id (0 to NumWorkers()-1) out of rotation
+// for up to d so it can be profiled or inspected, returning the worker's
+// pid. If the worker is handling a request QuiesceWorker waits for it to
+// finish first. Calling release returns the worker to rotation early.
+func (p *WorkerPool) QuiesceWorker(ctx context.Context, id int, d time.Duration) (pid int, release func(), err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id < 0 || id >= len(p.ctl) {
+		return 0, nil, fmt.Errorf("no worker with id %d", id)
+	}
+
+	releaseChan := make(chan struct{})
+	respChan := make(chan interface{}, 1)
+	select {
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	case p.ctl[id] <- ctlRequest{
+		Req:      quiesceWorkerRequest{d: d, release: releaseChan},
+		RespChan: respChan,
+	}:
+	}
+
+	var r interface{}
+	select {
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	case r = <-respChan:
+	}
+
+	once := sync.Once{}
+	return r.(int), func() { once.Do(func() { close(releaseChan) }) }, nil
+}
+
+// DispatchToWorker sends req to worker id (0 to NumWorkers()-1) instead
+// of whichever worker is free, to observe a worker suspected of being
+// bad. It is a debugging aid and not meant for routing production
+// traffic: only one DispatchToWorker runs at a time, it fails with
+// ErrWorkerPoolBusy if the worker doesn't take the request within
+// WorkerRendezvousTimeout, and admission control, idempotency and the
+// other Dispatch features are not applied.
+func (p *WorkerPool) DispatchToWorker(ctx context.Context, id int, req HTTPRequest) (HTTPResponse, error) {
+	if !atomic.CompareAndSwapInt32(&p.directDispatch, 0, 1) {
+		return HTTPResponse{}, fmt.Errorf("%w: another DispatchToWorker is in progress", ErrWorkerPoolBusy)
+	}
+	defer atomic.StoreInt32(&p.directDispatch, 0)
+
+	// Not held while the worker handles the request, so workers can
+	// still be spawned and removed meanwhile.
+	p.mu.Lock()
+	if id < 0 || id >= len(p.ctl) {
+		p.mu.Unlock()
+		return HTTPResponse{}, fmt.Errorf("no worker with id %d", id)
+	}
+	ctl := p.ctl[id]
+	p.mu.Unlock()
+
+	t := time.NewTimer(p.cfg.WorkerRendezvousTimeout)
+	defer t.Stop()
+	respChan := make(chan interface{}, 1)
+	select {
+	case <-ctx.Done():
+		return HTTPResponse{}, ctx.Err()
+	case <-p.workerCtx.Done():
+		return HTTPResponse{}, ErrWorkerPoolClosed
+	case <-t.C:
+		return HTTPResponse{}, fmt.Errorf("%w: worker %d did not take the request", ErrWorkerPoolBusy, id)
+	case ctl <- ctlRequest{
+		Req:      directRequest{req: req},
+		RespChan: respChan,
+	}:
+	}
+
+	select {
+	case <-ctx.Done():
+		return HTTPResponse{}, ctx.Err()
+	case <-p.workerCtx.Done():
+		return HTTPResponse{}, ErrWorkerPoolClosed
+	case r := <-respChan:
+		resp := r.(workResponse)
+		if resp.Err != nil {
+			return HTTPResponse{}, fmt.Errorf("request failed: %w", resp.Err)
+		}
+		return resp.Resp, nil
+	}
+}
+
+func (p *WorkerPool) setPaused(paused bool) {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+
+	if p.pause.paused == paused {
+		return
+	}
+	close(p.pause.changed)
+	p.pause = pauseState{paused: paused, changed: make(chan struct{})}
+}
+
+// Pause stops workers from accepting new requests without stopping
+// the workers. While paused, Dispatch waits for the pool to be resumed
+// until its usual timeouts expire, or fails immediately with
+// ErrWorkerPoolPaused if RejectWhenPaused is set.
+func (p *WorkerPool) Pause() {
+	p.setPaused(true)
+}
+
+func (p *WorkerPool) Resume() {
+	p.setPaused(false)
+}
+
+func (p *WorkerPool) Paused() bool {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	return p.pause.paused
+}
+
+// workerDispatchChan returns the channel idle workers take requests
+// from, which is nil while paused, and a channel that is closed when
+// the pool is paused or resumed.
+func (p *WorkerPool) workerDispatchChan() (chan workRequest, chan struct{}) {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	if p.pause.paused {
+		return nil, p.pause.changed
+	}
+	return p.dispatch, p.pause.changed
+}
+
+type ShutdownReport struct {
+	// Requests waiting for or being handled by a worker when the pool
+	// stopped accepting requests, by Drain or Close. This is always
+	// DrainedRequests plus AbandonedRequests.
+	InFlightRequests int64
+	// Requests from InFlightRequests that finished before the pool was
+	// closed, only Drain leaves time for any to.
+	DrainedRequests int64
+	// Requests still waiting for or being handled by a worker when
+	// the pool was closed, these fail with ErrWorkerPoolClosed.
+	AbandonedRequests int64
+	// How long each worker took to exit after being asked to.
+	WorkerExitTimes []time.Duration
+	// Workers killed after exceeding WorkerShutdownTimeout.
+	KilledWorkers int
+}
+
+func (p *WorkerPool) recordWorkerShutdown(exitTime time.Duration, killed bool) {
+	p.shutdownMu.Lock()
+	defer p.shutdownMu.Unlock()
+	p.shutdownReport.WorkerExitTimes = append(p.shutdownReport.WorkerExitTimes, exitTime)
+	if killed {
+		p.shutdownReport.KilledWorkers += 1
+	}
+}
+
+// beginShutdown records the requests in flight when the pool stops
+// accepting requests, only the first call does anything.
+func (p *WorkerPool) beginShutdown() {
+	p.shutdownMu.Lock()
+	defer p.shutdownMu.Unlock()
+	if p.shutdownInflight != nil {
+		return
+	}
+	p.inflightMu.Lock()
+	defer p.inflightMu.Unlock()
+	p.shutdownInflight = make(map[*inflightRequest]struct{}, len(p.inflight))
+	for r := range p.inflight {
+		p.shutdownInflight[r] = struct{}{}
+	}
+}
+
+// Close stops all workers and waits for them to exit, reporting
+// what was interrupted.
+func (p *WorkerPool) Close() ShutdownReport {
+	p.beginShutdown()
+	p.shutdownMu.Lock()
+	if !p.closing {
+		p.closing = true
+		p.inflightMu.Lock()
+		// Requests that registered after beginShutdown had already
+		// passed the draining check, they count as in flight too.
+		abandoned := int64(len(p.inflight))
+		drained := int64(0)
+		for r := range p.shutdownInflight {
+			if _, ok := p.inflight[r]; !ok {
+				drained += 1
+			}
+		}
+		p.inflightMu.Unlock()
+		p.shutdownReport.InFlightRequests = drained + abandoned
+		p.shutdownReport.DrainedRequests = drained
+		p.shutdownReport.AbandonedRequests = abandoned
+	}
+	p.shutdownMu.Unlock()
+
+	p.idleMu.Lock()
+	if !p.idle.closed {
+		p.idle.closed = true
+		if p.idle.idleWorkers == 0 {
+			close(p.idle.ch)
+		}
+	}
+	p.idleMu.Unlock()
+
 	p.cancelAllWorkers()
 	p.wg.Wait()
+
+	p.shutdownMu.Lock()
+	defer p.shutdownMu.Unlock()
+	report := p.shutdownReport
+	report.WorkerExitTimes = append([]time.Duration{}, report.WorkerExitTimes...)
+	return report
 }
 
 type HandlerConfig struct {
-	Logfn           func(keyvals ...interface{})
-	StaticCompress  bool
-	StaticNoBrotli  bool
-	StaticRoot      string
-	StaticUrlPrefix string
+	Logfn                  func(keyvals ...interface{})
+	StaticCompress         bool
+	StaticNoBrotli         bool
+	StaticRoot             string
+	StaticUrlPrefix        string
+	LogRequestOnError      bool
+	LogRequestMaxBodyBytes int
+	RedactRequest          func(req HTTPRequest) HTTPRequest
+	NormalizeHeaders       bool
+	StrictHeaders          bool
+	HealthCheckPath        string
+	// Gzip worker responses for clients that accept it, unless the
+	// worker set Content-Encoding because it compressed them itself.
+	CompressResponses bool
+}
+
+// logRequestOnError logs a failed request in full so it can be
+// reproduced. RedactRequest is called on a copy of the request before
+// it is logged so secrets can be removed.
+func logRequestOnError(logfn func(keyvals ...interface{}), cfg HandlerConfig, req HTTPRequest, err error) {
+	if cfg.RedactRequest != nil {
+		headers := make(map[string]string, len(req.Headers))
+		for k, v := range req.Headers {
+			headers[k] = v
+		}
+		req.Headers = headers
+		req.Body = append([]byte{}, req.Body...)
+		req = cfg.RedactRequest(req)
+	}
+	body := req.Body
+	if len(body) > cfg.LogRequestMaxBodyBytes {
+		body = body[:cfg.LogRequestMaxBodyBytes]
+	}
+	logfn(
+		"msg", "error while dispatching to worker",
+		"err", err,
+		"remote-address", req.RemoteAddress,
+		"method", req.Method,
+		"uri", req.Uri,
+		"headers", fmt.Sprint(req.Headers),
+		"body", body,
+		"body-size", len(req.Body),
+	)
 }
 
 func MakeHTTPHandler(pool *WorkerPool, cfg HandlerConfig) fasthttp.RequestHandler {
@@ -583,33 +2468,49 @@ func MakeHTTPHandler(pool *WorkerPool, cfg HandlerConfig) fasthttp.RequestHandle
 
 	logfn := cfg.Logfn
 
-	return func(ctx *fasthttp.RequestCtx) {
+	workerRequestHandler := func(ctx *fasthttp.RequestCtx) {
 		uri := ctx.Request.URI()
-
-		if staticFileRequestHandler != nil {
-			if bytes.HasPrefix(uri.Path(), staticUrlPrefixBytes) {
-				staticFileRequestHandler(ctx)
-				return
-			}
-		}
-
 		reqHeaders := make(map[string]string)
 		ctx.Request.Header.VisitAll(func(key, value []byte) {
 			reqHeaders[string(key)] = string(value)
 		})
 
-		resp, err := pool.Dispatch(HTTPRequest{
+		req := HTTPRequest{
 			RemoteAddress: ctx.RemoteAddr().String(),
 			Uri:           string(uri.FullURI()),
 			Headers:       reqHeaders,
 			Method:        string(ctx.Request.Header.Method()),
 			Body:          ctx.Request.Body(),
-		})
+		}
+		resp, err := pool.Dispatch(req)
 		if err != nil {
-			logfn("msg", "error while dispatching to worker", "err", err)
-			if err == ErrWorkerPoolBusy {
+			logfn := pool.requestLogfn(logfn, req)
+			if cfg.LogRequestOnError {
+				logRequestOnError(logfn, cfg, req, err)
+			} else {
+				logfn("msg", "error while dispatching to worker", "err", err)
+			}
+			if err == ErrWorkerPoolBusy || err == ErrQueueTimeout {
 				ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
 				ctx.SetBody([]byte("server overloaded\n"))
+			} else if err == ErrWorkerPoolPaused {
+				ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+				ctx.SetBody([]byte("server paused\n"))
+			} else if err == ErrPoolNotReady {
+				ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+				ctx.SetBody([]byte("server starting\n"))
+			} else if err == ErrNoHealthyWorkers {
+				ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+				ctx.SetBody([]byte("server unavailable\n"))
+			} else if errors.Is(err, ErrInvalidRequest) {
+				ctx.SetStatusCode(fasthttp.StatusBadRequest)
+				ctx.SetBody([]byte("bad request\n"))
+			} else if errors.Is(err, ErrRequestCancelled) {
+				ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+				ctx.SetBody([]byte("request cancelled\n"))
+			} else if err == ErrRateLimited {
+				ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+				ctx.SetBody([]byte("too many requests\n"))
 			} else {
 				ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 				ctx.SetBody([]byte("internal server error\n"))
@@ -617,8 +2518,20 @@ func MakeHTTPHandler(pool *WorkerPool, cfg HandlerConfig) fasthttp.RequestHandle
 			return
 		}
 
+		headers := resp.Headers
+		if cfg.NormalizeHeaders {
+			headers, err = NormalizeHeaders(headers, cfg.StrictHeaders)
+			if err != nil {
+				logfn := pool.requestLogfn(logfn, req)
+				logfn("msg", "worker sent invalid response headers", "err", err, "uri", req.Uri)
+				ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+				ctx.SetBody([]byte("internal server error\n"))
+				return
+			}
+		}
+
 		ctx.SetStatusCode(resp.Status)
-		for hdr, values := range resp.Headers {
+		for hdr, values := range headers {
 			for i, value := range values {
 				if i == 0 {
 					ctx.Response.Header.Set(hdr, value)
@@ -627,6 +2540,36 @@ func MakeHTTPHandler(pool *WorkerPool, cfg HandlerConfig) fasthttp.RequestHandle
 				}
 			}
 		}
+		if cfg.CompressResponses && len(ctx.Response.Header.Peek("Vary")) == 0 {
+			ctx.Response.Header.Set("Vary", "Accept-Encoding")
+		}
 		ctx.SetBody(resp.Body)
 	}
+	if cfg.CompressResponses {
+		// Leaves bodies with a Content-Encoding alone.
+		workerRequestHandler = fasthttp.CompressHandler(workerRequestHandler)
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		uri := ctx.Request.URI()
+
+		if staticFileRequestHandler != nil {
+			if bytes.HasPrefix(uri.Path(), staticUrlPrefixBytes) {
+				staticFileRequestHandler(ctx)
+				return
+			}
+		}
+
+		if cfg.HealthCheckPath != "" && string(uri.Path()) == cfg.HealthCheckPath {
+			if pool.Healthy() {
+				ctx.SetBody([]byte("ok\n"))
+			} else {
+				ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+				ctx.SetBody([]byte("unavailable\n"))
+			}
+			return
+		}
+
+		workerRequestHandler(ctx)
+	}
 }
@@ -0,0 +1,965 @@
+package poolparty
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"git.sr.ht/~sircmpwn/go-bare"
+)
+
+// The test binary doubles as a worker when this is set, see testWorker.
+const testWorkerEnv = "POOLPARTY_TEST_WORKER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testWorkerEnv) != "" {
+		mode := ""
+		if len(os.Args) > 1 {
+			mode = os.Args[1]
+		}
+		testWorker(mode)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testWorker speaks the worker protocol on stdin and fd 3. It answers
+// each request with its uri as the body, after sleeping for
+// /sleep/MILLISECONDS, and exits without answering for /exit or after
+// half an answer for /partial. /bytes/N answers with N bytes instead.
+// It never answers /hang, or stops halfway through for /hang-partial,
+// and /claim-huge sends a frame length of almost 2 GiB and no frame.
+// /fd/N writes "fd N" to file descriptor N before answering, and
+// /status/N answers with the status N instead of 200. A uri
+// ending in /headers is answered with the request headers as sorted
+// "name: value" lines, and one ending in /response-headers with
+// testWorkerResponseHeaders.
+//
+// With the mode "crash" it exits right after the handshake, with the
+// mode "version" it claims a newer protocol version.
+func testWorker(mode string) {
+	in := bufio.NewReader(os.Stdin)
+	out := os.NewFile(3, "responses")
+	for {
+		var lenBuf [4]byte
+		_, err := io.ReadFull(in, lenBuf[:])
+		if err != nil {
+			return
+		}
+		frame := make([]byte, binary.LittleEndian.Uint32(lenBuf[:]))
+		_, err = io.ReadFull(in, frame)
+		if err != nil {
+			return
+		}
+		br := bare.NewReader(bytes.NewReader(frame))
+		variant, _ := br.ReadUint()
+		var resp bytes.Buffer
+		bw := bare.NewWriter(&resp)
+		switch variant {
+		case 0:
+			_, _ = br.ReadString()
+			uri, _ := br.ReadString()
+			_, _ = br.ReadString()
+			numHeaders, _ := br.ReadUint()
+			var headerLines []string
+			for i := uint64(0); i < numHeaders; i++ {
+				name, _ := br.ReadString()
+				value, _ := br.ReadString()
+				headerLines = append(headerLines, name+": "+value+"\n")
+			}
+			switch {
+			case strings.HasPrefix(uri, "/sleep/"):
+				ms, _ := strconv.Atoi(strings.TrimPrefix(uri, "/sleep/"))
+				time.Sleep(time.Duration(ms) * time.Millisecond)
+			case uri == "/exit":
+				os.Exit(1)
+			case uri == "/hang":
+				select {}
+			case strings.HasPrefix(uri, "/fd/"):
+				fd, _ := strconv.Atoi(strings.TrimPrefix(uri, "/fd/"))
+				_, _ = os.NewFile(uintptr(fd), "extra").Write([]byte(fmt.Sprintf("fd %d\n", fd)))
+			case uri == "/claim-huge":
+				_, _ = out.Write([]byte{0xff, 0xff, 0xff, 0x7f})
+				select {}
+			}
+			body := []byte(uri)
+			if strings.HasPrefix(uri, "/bytes/") {
+				n, _ := strconv.Atoi(strings.TrimPrefix(uri, "/bytes/"))
+				body = bytes.Repeat([]byte{'x'}, n)
+			}
+			if strings.HasSuffix(uri, "/headers") {
+				sort.Strings(headerLines)
+				body = []byte(strings.Join(headerLines, ""))
+			}
+			status := 200
+			if strings.HasPrefix(uri, "/status/") {
+				status, _ = strconv.Atoi(strings.TrimPrefix(uri, "/status/"))
+			}
+			_ = bw.WriteUint(0)
+			_ = bw.WriteUint(uint64(status))
+			if strings.HasSuffix(uri, "/response-headers") {
+				_ = bw.WriteUint(uint64(len(testWorkerResponseHeaders)))
+				for _, hdr := range testWorkerResponseHeaders {
+					_ = bw.WriteString(hdr.name)
+					_ = bw.WriteUint(uint64(len(hdr.values)))
+					for _, value := range hdr.values {
+						_ = bw.WriteString(value)
+					}
+				}
+			} else {
+				_ = bw.WriteUint(0)
+			}
+			_ = bw.WriteData(body)
+			_ = bw.WriteBool(false)
+			if uri == "/partial" || uri == "/hang-partial" {
+				var lenBuf [4]byte
+				binary.LittleEndian.PutUint32(lenBuf[:], uint32(resp.Len()))
+				_, _ = out.Write(append(lenBuf[:], resp.Bytes()[:resp.Len()/2]...))
+				if uri == "/hang-partial" {
+					select {}
+				}
+				os.Exit(1)
+			}
+		case 2:
+			_ = bw.WriteUint(2)
+			if mode == "version" {
+				_ = bw.WriteUint(protocolVersion + 1)
+			} else {
+				_ = bw.WriteUint(protocolVersion)
+			}
+			if mode == "crash" {
+				testWorkerWriteFrame(out, resp.Bytes())
+				os.Exit(1)
+			}
+		case 3:
+			_ = bw.WriteUint(4)
+		default:
+			// Health checks have no answer.
+			continue
+		}
+		testWorkerWriteFrame(out, resp.Bytes())
+	}
+}
+
+var testWorkerResponseHeaders = []struct {
+	name   string
+	values []string
+}{
+	{"x-repeated", []string{"a", "b", "a"}},
+	{"X-Repeated", []string{"c"}},
+	{"X-Empty", []string{""}},
+	{"content-type", []string{"text/plain"}},
+	{"Content-Type", []string{"text/html"}},
+	{"Set-Cookie", []string{"a=1", "a=1"}},
+	{"X-Long" + strings.Repeat("n", 4096), []string{"long"}},
+}
+
+func testWorkerWriteFrame(out io.Writer, frame []byte) {
+	var lenBuf [4]byte
+	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(frame)))
+	_, _ = out.Write(append(lenBuf[:], frame...))
+}
+
+func testPoolConfig() PoolConfig {
+	cfg := DefaultPoolConfig()
+	cfg.WorkerProc = []string{os.Args[0]}
+	cfg.WorkerRestartDelay = 10 * time.Millisecond
+	cfg.WorkerSpawnTimeout = 5 * time.Second
+	return cfg
+}
+
+// testWorkerProc runs testWorker in the given mode.
+func testWorkerProc(mode string) []string {
+	return []string{os.Args[0], mode}
+}
+
+// waitForGoroutines fails t unless the number of goroutines drops to
+// at most n soon.
+func waitForGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines still running, expected at most %d", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestPool(t testing.TB, cfg PoolConfig) *WorkerPool {
+	os.Setenv(testWorkerEnv, "1")
+	p, err := NewWorkerPool(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// Workers are killed, exit and die halfway through a response while
+// requests are in flight, every Dispatch must still return.
+func TestDispatchReturnsWhileWorkersAreKilled(t *testing.T) {
+	cfg := testPoolConfig()
+	cfg.MinWorkers = 4
+	cfg.MaxWorkers = 4
+	cfg.WorkerRequestTimeout = 5 * time.Second
+	p := newTestPool(t, cfg)
+	defer p.Close()
+
+	stopKilling := make(chan struct{})
+	killerDone := make(chan struct{})
+	go func() {
+		defer close(killerDone)
+		for {
+			select {
+			case <-stopKilling:
+				return
+			case <-time.After(time.Duration(rand.Intn(20)) * time.Millisecond):
+			}
+			stats := p.WorkerStats()
+			if len(stats) == 0 {
+				continue
+			}
+			if pid := stats[rand.Intn(len(stats))].Pid; pid != 0 {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	}()
+
+	uris := []string{"/", "/sleep/1", "/sleep/10", "/exit", "/partial"}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				uri := uris[rand.Intn(len(uris))]
+				resp, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: uri})
+				if err != nil {
+					continue
+				}
+				if string(resp.Body) != uri {
+					t.Errorf("response for %s has body %q", uri, resp.Body)
+				}
+				mu.Lock()
+				succeeded += 1
+				mu.Unlock()
+			}
+		}()
+	}
+
+	allReturned := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allReturned)
+	}()
+	select {
+	case <-allReturned:
+	case <-time.After(60 * time.Second):
+		t.Fatal("Dispatch did not return while workers were being killed")
+	}
+	close(stopKilling)
+	<-killerDone
+
+	if succeeded == 0 {
+		t.Fatal("no request succeeded")
+	}
+	// The pool recovers once the killing stops, workers killed last may
+	// not have been noticed yet and fail a request each.
+	var resp HTTPResponse
+	var err error
+	for i := uint32(0); i <= cfg.MaxWorkers; i++ {
+		resp, err = p.Dispatch(HTTPRequest{Method: "GET", Uri: "/"})
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "/" {
+		t.Fatalf("unexpected body %q", resp.Body)
+	}
+}
+
+// Requests abandoned while a worker has them must not leave a response
+// behind on a pooled channel for a later request to receive.
+func TestAbandonedRequestLeavesNoStaleResponse(t *testing.T) {
+	cfg := testPoolConfig()
+	closed := newTestPool(t, cfg)
+	abandoned := make(chan error, 1)
+	go func() {
+		_, err := closed.Dispatch(HTTPRequest{Method: "GET", Uri: "/sleep/100"})
+		abandoned <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	closed.Close()
+	if err := <-abandoned; err != ErrWorkerPoolClosed {
+		t.Fatalf("expected ErrWorkerPoolClosed, got %v", err)
+	}
+
+	p := newTestPool(t, cfg)
+	defer p.Close()
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, _, err := p.DispatchTo(ctx, HTTPRequest{Method: "GET", Uri: "/sleep/50"}, ioutil.Discard)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+		}
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			p.CancelWhere(func(info RequestInfo) bool { return info.Uri == "/sleep/50" })
+		}()
+		_, err = p.Dispatch(HTTPRequest{Method: "GET", Uri: "/sleep/50"})
+		if !errors.Is(err, ErrRequestCancelled) {
+			t.Fatalf("expected ErrRequestCancelled, got %v", err)
+		}
+
+		uri := fmt.Sprintf("/request/%d", i)
+		resp, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: uri})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Body) != uri {
+			t.Fatalf("request for %s got the response %q", uri, resp.Body)
+		}
+	}
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	p := newTestPool(b, testPoolConfig())
+	defer p.Close()
+	req := HTTPRequest{Method: "GET", Uri: "/"}
+	_, err := p.Dispatch(req)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := p.Dispatch(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// slowWriter takes its time over each write and notes any write made
+// once returned is set. buf is deliberately unsynchronized so the race
+// detector also catches a late write.
+type slowWriter struct {
+	buf      bytes.Buffer
+	started  chan struct{}
+	returned int32
+	late     int32
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&w.returned) != 0 {
+		atomic.StoreInt32(&w.late, 1)
+	}
+	if w.buf.Len() == 0 {
+		close(w.started)
+	}
+	time.Sleep(time.Millisecond)
+	return w.buf.Write(b)
+}
+
+func TestDispatchToDoesNotWriteAfterReturning(t *testing.T) {
+	p := newTestPool(t, testPoolConfig())
+	defer p.Close()
+	for i := 0; i < 5; i++ {
+		w := &slowWriter{started: make(chan struct{})}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-w.started
+			cancel()
+		}()
+		_, _, err := p.DispatchTo(ctx, HTTPRequest{Method: "GET", Uri: "/bytes/8000000"}, w)
+		atomic.StoreInt32(&w.returned, 1)
+		cancel()
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+		n := w.buf.Len()
+		if n == 0 || n >= 8000000 {
+			t.Fatalf("expected the cancelled response to be partly written, got %d bytes", n)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if atomic.LoadInt32(&w.late) != 0 || w.buf.Len() != n {
+			t.Fatal("writer used after DispatchTo returned")
+		}
+	}
+}
+
+// A retired slot whose worker keeps crashing must not start another,
+// even with no restart delay to wait out. Without a check a relaunch
+// only loses a select with retiring some of the time, so try a few.
+func TestRetiredCrashingWorkerIsNotRelaunched(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		cfg := testPoolConfig()
+		cfg.WorkerProc = testWorkerProc("crash")
+		cfg.MinWorkers = 0
+		cfg.MaxWorkers = 1
+		cfg.WorkerRestartDelay = 0
+		cfg.RetireGrace = time.Minute
+		var mu sync.Mutex
+		starts := 0
+		cfg.Logfn = func(keyvals ...interface{}) {
+			if len(keyvals) > 1 && keyvals[1] == "worker spawned" {
+				mu.Lock()
+				starts += 1
+				mu.Unlock()
+			}
+		}
+		p := newTestPool(t, cfg)
+		p.SpawnWorker()
+		for {
+			mu.Lock()
+			n := starts
+			mu.Unlock()
+			if n >= 3 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		mu.Lock()
+		p.RemoveWorker()
+		before := starts
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		after := starts
+		mu.Unlock()
+		p.Close()
+		// One may have been starting as the slot was retired.
+		if after-before > 1 {
+			t.Fatalf("%d workers started after the slot was retired", after-before)
+		}
+	}
+}
+
+// The request timeout firing while the response is being read, before
+// any of it or partway through, answers the request exactly once.
+func TestTimeoutWhileReadingResponseAnswersOnce(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	cfg := testPoolConfig()
+	cfg.WorkerRequestTimeout = 100 * time.Millisecond
+	p := newTestPool(t, cfg)
+	for _, uri := range []string{"/hang", "/hang-partial"} {
+		// Sent like dispatchWork would, but with room for a second
+		// answer so one would be seen.
+		respChan := make(chan workResponse, 2)
+		select {
+		case p.dispatch <- workRequest{Req: HTTPRequest{Method: "GET", Uri: uri}, RespChan: respChan}:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no worker took the request")
+		}
+		select {
+		case r := <-respChan:
+			if !errors.Is(r.Err, ErrWorkerTimeout) {
+				t.Fatalf("expected ErrWorkerTimeout for %s, got %v", uri, r.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was never answered", uri)
+		}
+		select {
+		case r := <-respChan:
+			t.Fatalf("%s was answered twice, then with %+v", uri, r)
+		case <-time.After(300 * time.Millisecond):
+		}
+
+		resp, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Body) != "/" {
+			t.Fatalf("unexpected body %q", resp.Body)
+		}
+	}
+	p.Close()
+	waitForGoroutines(t, goroutines)
+}
+
+// A caller that gives up right after handing its request to a worker
+// leaves the answer in the buffered channel, the worker isn't blocked
+// or replaced and serves the next request.
+func TestAbandonedDirectRequestFreesWorker(t *testing.T) {
+	p := newTestPool(t, testPoolConfig())
+	defer p.Close()
+	_, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := p.WorkerStats()[0].Pid
+	goroutines := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			cancel()
+		}()
+		_, err := p.DispatchToWorker(ctx, 0, HTTPRequest{Method: "GET", Uri: "/sleep/20"})
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+
+		resp, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Body) != "/" {
+			t.Fatalf("unexpected body %q", resp.Body)
+		}
+		if stats := p.WorkerStats()[0]; stats.Pid != pid {
+			t.Fatalf("worker %d was replaced by %d", pid, stats.Pid)
+		}
+	}
+	waitForGoroutines(t, goroutines)
+	if restarts := p.Stats().WorkerRestarts; restarts != 0 {
+		t.Fatalf("expected no restarts, got %d", restarts)
+	}
+}
+
+func TestProtocolVersionMismatchIsRejected(t *testing.T) {
+	cfg := testPoolConfig()
+	cfg.WorkerProc = testWorkerProc("version")
+	cfg.TotalTimeout = 300 * time.Millisecond
+	mismatches := make(chan string, 16)
+	cfg.OnWorkerEvent = func(req HTTPRequest, kind string, data []byte) {
+		if kind == "protocol-mismatch" {
+			select {
+			case mismatches <- string(data):
+			default:
+			}
+		}
+	}
+	var mu sync.Mutex
+	logged := false
+	cfg.Logfn = func(keyvals ...interface{}) {
+		if len(keyvals) > 1 && keyvals[1] == "worker handshake failed" {
+			mu.Lock()
+			logged = true
+			mu.Unlock()
+		}
+	}
+	p := newTestPool(t, cfg)
+	defer p.Close()
+
+	select {
+	case msg := <-mismatches:
+		want := fmt.Sprintf("worker speaks version %d, want version %d", protocolVersion+1, protocolVersion)
+		if !strings.Contains(msg, want) {
+			t.Fatalf("expected %q in %q", want, msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no protocol-mismatch event")
+	}
+	mu.Lock()
+	if !logged {
+		t.Error("handshake failure was not logged")
+	}
+	mu.Unlock()
+
+	_, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: "/"})
+	if err != ErrQueueTimeout {
+		t.Fatalf("expected ErrQueueTimeout, got %v", err)
+	}
+	if pid := p.WorkerStats()[0].Pid; pid != 0 {
+		t.Fatalf("worker %d is serving despite the mismatch", pid)
+	}
+}
+
+func TestOversizedResponseIsRejected(t *testing.T) {
+	cfg := testPoolConfig()
+	cfg.WorkerMaxResponseSize = 1024
+	p := newTestPool(t, cfg)
+	defer p.Close()
+
+	for i, uri := range []string{"/bytes/4096", "/claim-huge"} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: uri})
+		runtime.ReadMemStats(&after)
+		if err == nil || !strings.Contains(err.Error(), "exceeds the maximum of 1024 bytes") {
+			t.Fatalf("expected the size error for %s, got %v", uri, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64*1024*1024 {
+			t.Fatalf("%d bytes allocated reading %s", allocated, uri)
+		}
+
+		// The worker's pipe is left mid-frame, so it is replaced.
+		resp, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Body) != "/" {
+			t.Fatalf("unexpected body %q", resp.Body)
+		}
+		if restarts := p.Stats().WorkerRestarts; restarts != uint64(i+1) {
+			t.Fatalf("expected %d restarts, got %d", i+1, restarts)
+		}
+	}
+}
+
+// Responses arriving right around the request timeout, some while the
+// request body is still being written, each get exactly one outcome and
+// leave the pool working.
+func TestTimeoutBoundaryAnswersOnce(t *testing.T) {
+	cfg := testPoolConfig()
+	cfg.MinWorkers = 4
+	cfg.MaxWorkers = 4
+	cfg.WorkerRequestTimeout = 20 * time.Millisecond
+	p := newTestPool(t, cfg)
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var respChans []chan workResponse
+	timedOut, succeeded := 0, 0
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				uri := fmt.Sprintf("/sleep/%d", 15+rand.Intn(11))
+				req := HTTPRequest{Method: "GET", Uri: uri}
+				if rand.Intn(4) == 0 {
+					req.Body = make([]byte, 256*1024)
+				}
+				respChan := make(chan workResponse, 2)
+				select {
+				case p.dispatch <- workRequest{Req: req, RespChan: respChan}:
+				case <-time.After(5 * time.Second):
+					t.Error("no worker took the request")
+					return
+				}
+				var r workResponse
+				select {
+				case r = <-respChan:
+				case <-time.After(5 * time.Second):
+					t.Errorf("%s was never answered", uri)
+					return
+				}
+				mu.Lock()
+				respChans = append(respChans, respChan)
+				switch {
+				case r.Err == nil && string(r.Resp.Body) == uri:
+					succeeded += 1
+				case errors.Is(r.Err, ErrWorkerTimeout):
+					timedOut += 1
+				default:
+					t.Errorf("unexpected outcome for %s: %+v", uri, r)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	time.Sleep(100 * time.Millisecond)
+	for _, respChan := range respChans {
+		select {
+		case r := <-respChan:
+			t.Fatalf("request answered twice, then with %+v", r)
+		default:
+		}
+	}
+	t.Logf("%d succeeded, %d timed out", succeeded, timedOut)
+	if succeeded == 0 || timedOut == 0 {
+		t.Fatal("requests didn't straddle the timeout")
+	}
+	resp, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "/" {
+		t.Fatalf("unexpected body %q", resp.Body)
+	}
+}
+
+func TestTotalTimeoutSpentQueueing(t *testing.T) {
+	cfg := testPoolConfig()
+	cfg.TotalTimeout = 100 * time.Millisecond
+	p := newTestPool(t, cfg)
+	defer p.Close()
+	_, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keeps the only worker busy for longer than the budget.
+	busy := make(chan error, 1)
+	go func() {
+		_, err := p.DispatchToWorker(context.Background(), 0, HTTPRequest{Method: "GET", Uri: "/sleep/300"})
+		busy <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	_, err = p.Dispatch(HTTPRequest{Method: "GET", Uri: "/queued"})
+	if !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("expected ErrQueueTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Fatalf("queue timeout took %s", d)
+	}
+	if err := <-busy; err != nil {
+		t.Fatal(err)
+	}
+	// Only the first request and the one keeping the worker busy
+	// reached it.
+	if requests := p.WorkerStats()[0].Requests; requests != 2 {
+		t.Fatalf("expected 2 requests handled, got %d", requests)
+	}
+}
+
+func TestTotalTimeoutSpentHandling(t *testing.T) {
+	cfg := testPoolConfig()
+	cfg.TotalTimeout = 100 * time.Millisecond
+	p := newTestPool(t, cfg)
+	defer p.Close()
+	_, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = p.Dispatch(HTTPRequest{Method: "GET", Uri: "/sleep/1000"})
+	if !errors.Is(err, ErrExecTimeout) {
+		t.Fatalf("expected ErrExecTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("exec timeout took %s", d)
+	}
+}
+
+// The first attempt to start the worker fails, the slot retries and the
+// pool recovers without counting it as a crash loop.
+func TestPoolRecoversFromFailedSpawn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poolparty-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	worker := dir + "/worker"
+	err = ioutil.WriteFile(worker, []byte("#!/bin/sh\nexec "+os.Args[0]+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testPoolConfig()
+	cfg.WorkerProc = []string{worker}
+	cfg.MinWorkers = 0
+	cfg.MaxRestartsPerWindow = 2
+	spawnFailed := make(chan struct{}, 1)
+	cfg.Logfn = func(keyvals ...interface{}) {
+		if len(keyvals) > 1 && keyvals[1] == "unable to spawn worker" {
+			select {
+			case spawnFailed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	p := newTestPool(t, cfg)
+	defer p.Close()
+
+	// Checked when the pool is created, so only fails from now on.
+	err = os.Chmod(worker, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SpawnWorker()
+	select {
+	case <-spawnFailed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker did not fail to start")
+	}
+	err = os.Chmod(worker, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "/" {
+		t.Fatalf("unexpected body %q", resp.Body)
+	}
+	if p.Stats().RestartGuardTripped {
+		t.Fatal("restart guard tripped")
+	}
+}
+
+func TestIsTransientSpawnError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{&os.PathError{Op: "fork/exec", Path: "worker", Err: syscall.EAGAIN}, true},
+		{&os.PathError{Op: "fork/exec", Path: "worker", Err: syscall.EMFILE}, true},
+		{fmt.Errorf("pipe: %w", syscall.ENFILE), true},
+		{syscall.EINTR, true},
+		{syscall.ENOMEM, true},
+		{&os.PathError{Op: "fork/exec", Path: "worker", Err: syscall.ENOENT}, false},
+		{&os.PathError{Op: "fork/exec", Path: "worker", Err: syscall.EACCES}, false},
+		{errors.New("something else"), false},
+	} {
+		if got := isTransientSpawnError(tc.err); got != tc.transient {
+			t.Errorf("isTransientSpawnError(%v) = %t, want %t", tc.err, got, tc.transient)
+		}
+	}
+}
+
+// WorkerExtraFiles reach the worker in order from file descriptor 4.
+func TestWorkerExtraFiles(t *testing.T) {
+	cfg := testPoolConfig()
+	var readers []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		defer w.Close()
+		cfg.WorkerExtraFiles = append(cfg.WorkerExtraFiles, w)
+		readers = append(readers, bufio.NewReader(r))
+	}
+	p := newTestPool(t, cfg)
+	defer p.Close()
+
+	for i, rdr := range readers {
+		fd := 4 + i
+		_, err := p.Dispatch(HTTPRequest{Method: "GET", Uri: fmt.Sprintf("/fd/%d", fd)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := rdr.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("fd %d\n", fd); ln != want {
+			t.Fatalf("expected %q from the worker's fd %d, got %q", want, fd, ln)
+		}
+	}
+}
+
+func TestShutdownReportCountsDrainedRequests(t *testing.T) {
+	cfg := testPoolConfig()
+	cfg.MinWorkers = 2
+	cfg.MaxWorkers = 2
+	cfg.WorkerRequestTimeout = 10 * time.Second
+	p := newTestPool(t, cfg)
+
+	var wg sync.WaitGroup
+	for _, uri := range []string{"/sleep/100", "/hang"} {
+		uri := uri
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = p.Dispatch(HTTPRequest{Uri: uri})
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.InFlight() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("requests were not dispatched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	report := p.Drain(ctx, nil)
+	wg.Wait()
+	if report.InFlightRequests != 2 || report.DrainedRequests != 1 || report.AbandonedRequests != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+// Middleware runs on the caller's goroutine, a slow one must not keep
+// the worker from taking the next request.
+func TestSlowMiddlewareDoesNotHoldWorker(t *testing.T) {
+	p := newTestPool(t, testPoolConfig())
+	defer p.Close()
+
+	const n = 4
+	var responded sync.WaitGroup
+	responded.Add(n)
+	allResponded := make(chan struct{})
+	go func() {
+		responded.Wait()
+		close(allResponded)
+	}()
+	p.Use(func(next DispatchFunc) DispatchFunc {
+		return func(req HTTPRequest) (HTTPResponse, error) {
+			resp, err := next(req)
+			responded.Done()
+			select {
+			case <-allResponded:
+			case <-time.After(5 * time.Second):
+				t.Error("worker was held by post-processing")
+			}
+			return resp, err
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Dispatch(HTTPRequest{Uri: "/"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestInvalidStatusIsRejected(t *testing.T) {
+	for _, recycle := range []bool{false, true} {
+		cfg := testPoolConfig()
+		cfg.RecycleOnInvalidResponse = recycle
+		p := newTestPool(t, cfg)
+
+		if _, err := p.Dispatch(HTTPRequest{Uri: "/"}); err != nil {
+			t.Fatal(err)
+		}
+		pid := p.WorkerStats()[0].Pid
+		for _, uri := range []string{"/status/0", "/status/99", "/status/1000"} {
+			_, err := p.Dispatch(HTTPRequest{Uri: uri})
+			if !errors.Is(err, ErrInvalidResponse) {
+				t.Fatalf("expected ErrInvalidResponse for %s, got %v", uri, err)
+			}
+		}
+		resp, err := p.Dispatch(HTTPRequest{Uri: "/status/999"})
+		if err != nil || resp.Status != 999 {
+			t.Fatalf("unexpected response %v %v", resp.Status, err)
+		}
+		if samePid := p.WorkerStats()[0].Pid == pid; samePid == recycle {
+			t.Fatalf("worker replaced %v with RecycleOnInvalidResponse %v", !samePid, recycle)
+		}
+		p.Close()
+	}
+}
@@ -0,0 +1,274 @@
+package poolparty
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A PoolSet holds named worker pools and dispatches each request to the
+// pool named by its route function. If the route function is nil or
+// returns "", a pool is picked at random in proportion to the pools'
+// weights, e.g. to send a small share of traffic to a canary.
+type PoolSet struct {
+	route   func(req HTTPRequest) string
+	mu      sync.RWMutex
+	pools   map[string]*WorkerPool
+	weights map[string]uint32
+	// Requests routed by weight to each pool since the weights last
+	// changed, updated atomically.
+	weighted map[string]*uint64
+}
+
+func NewPoolSet(route func(req HTTPRequest) string) *PoolSet {
+	return &PoolSet{
+		route:    route,
+		pools:    make(map[string]*WorkerPool),
+		weights:  make(map[string]uint32),
+		weighted: make(map[string]*uint64),
+	}
+}
+
+func (s *PoolSet) Add(name string, pool *WorkerPool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pools[name]; ok {
+		return fmt.Errorf("worker pool %q already exists", name)
+	}
+	s.pools[name] = pool
+	s.weights[name] = 1
+	s.resetWeightedLocked()
+	return nil
+}
+
+// SetWeight sets the weight of a pool for requests routed by weight,
+// pools start with a weight of 1 and a weight of 0 takes a pool out of
+// weighted routing. It may be called while requests are being
+// dispatched, e.g. to shift traffic to a canary bit by bit.
+func (s *PoolSet) SetWeight(name string, weight uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pools[name]; !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownPool, name)
+	}
+	s.weights[name] = weight
+	s.resetWeightedLocked()
+	return nil
+}
+
+func (s *PoolSet) Weights() map[string]uint32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	weights := make(map[string]uint32, len(s.weights))
+	for name, weight := range s.weights {
+		weights[name] = weight
+	}
+	return weights
+}
+
+// resetWeightedLocked restarts the request counts behind the shares in
+// Stats, so they reflect the current weights.
+func (s *PoolSet) resetWeightedLocked() {
+	s.weighted = make(map[string]*uint64, len(s.pools))
+	for name := range s.pools {
+		s.weighted[name] = new(uint64)
+	}
+}
+
+// pickWeighted picks a pool at random in proportion to the weights.
+func (s *PoolSet) pickWeighted() (string, *WorkerPool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	total := uint64(0)
+	for _, weight := range s.weights {
+		total += uint64(weight)
+	}
+	if total == 0 {
+		return "", nil
+	}
+	n := uint64(rand.Int63n(int64(total)))
+	for name, weight := range s.weights {
+		if n < uint64(weight) {
+			atomic.AddUint64(s.weighted[name], 1)
+			return name, s.pools[name]
+		}
+		n -= uint64(weight)
+	}
+	panic("unreachable")
+}
+
+// Remove removes a pool from the set without closing it, returning nil
+// if there was no such pool.
+func (s *PoolSet) Remove(name string) *WorkerPool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pool := s.pools[name]
+	delete(s.pools, name)
+	if _, ok := s.weights[name]; ok {
+		delete(s.weights, name)
+		s.resetWeightedLocked()
+	}
+	return pool
+}
+
+// DrainPool removes a pool from the set and drains it, later requests
+// routed to it fail with ErrUnknownPool while the other pools keep
+// serving.
+func (s *PoolSet) DrainPool(ctx context.Context, name string) (ShutdownReport, error) {
+	pool := s.Remove(name)
+	if pool == nil {
+		return ShutdownReport{}, fmt.Errorf("%w: %q", ErrUnknownPool, name)
+	}
+	return pool.Drain(ctx, nil), nil
+}
+
+// ReloadPool replaces a pool with a new one configured the same way,
+// with the same middleware, except for its worker command and its
+// Admission controller, then drains the old pool. Admission controllers
+// keep state about the requests they admitted, so the new pool uses
+// admission, which may be nil, rather than sharing the old pool's.
+// Requests routed to the pool from then on wait for the new pool's
+// workers.
+func (s *PoolSet) ReloadPool(ctx context.Context, name string, workerProc []string, admission AdmissionController) (ShutdownReport, error) {
+	old := s.Pool(name)
+	if old == nil {
+		return ShutdownReport{}, fmt.Errorf("%w: %q", ErrUnknownPool, name)
+	}
+	cfg := old.cfg
+	cfg.Logfn = old.logfn.Load().(func(keyvals ...interface{}))
+	cfg.WorkerProc = workerProc
+	cfg.Admission = admission
+	// Don't hold the lock while a setup command runs.
+	pool, err := NewWorkerPool(cfg)
+	if err != nil {
+		return ShutdownReport{}, err
+	}
+	old.middlewareMu.Lock()
+	middleware := append([]Middleware(nil), old.middleware...)
+	old.middlewareMu.Unlock()
+	for _, mw := range middleware {
+		pool.Use(mw)
+	}
+
+	s.mu.Lock()
+	if s.pools[name] != old {
+		s.mu.Unlock()
+		pool.Close()
+		return ShutdownReport{}, fmt.Errorf("worker pool %q changed while reloading", name)
+	}
+	s.pools[name] = pool
+	s.mu.Unlock()
+	return old.Drain(ctx, nil), nil
+}
+
+func (s *PoolSet) Pool(name string) *WorkerPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pools[name]
+}
+
+// Dispatch sends req to the pool chosen by the route function, or by
+// weight, failing with ErrUnknownPool if there is no pool with that name
+// or every weight is 0.
+func (s *PoolSet) Dispatch(req HTTPRequest) (HTTPResponse, error) {
+	name := ""
+	if s.route != nil {
+		name = s.route(req)
+	}
+	var pool *WorkerPool
+	if name == "" {
+		name, pool = s.pickWeighted()
+	} else {
+		pool = s.Pool(name)
+	}
+	if pool == nil {
+		return HTTPResponse{}, fmt.Errorf("%w: %q", ErrUnknownPool, name)
+	}
+	return pool.Dispatch(req)
+}
+
+// Stats sums the stats of every pool, Paused is true only if all pools
+// are paused, RestartGuardTripped if any pool's guard is tripped and
+// AvgLatencyEMA is the average of the pools' weighted by their
+// Requests. WeightedShares holds the fraction of the requests routed
+// by weight since the weights last changed that went to each pool, to
+// check a canary gets the traffic intended.
+func (s *PoolSet) Stats() WorkerPoolStats {
+	poolStats := s.PoolStats()
+	total := WorkerPoolStats{Paused: len(poolStats) != 0}
+	total.WeightedShares = s.weightedShares()
+	latencySum := 0.0
+	for _, stats := range poolStats {
+		latencySum += float64(stats.AvgLatencyEMA) * float64(stats.Requests)
+		total.Workers += stats.Workers
+		total.WorkerRestarts += stats.WorkerRestarts
+		total.IdleReaped += stats.IdleReaped
+		total.Paused = total.Paused && stats.Paused
+		total.RestartGuardTripped = total.RestartGuardTripped || stats.RestartGuardTripped
+		total.Requests += stats.Requests
+		total.RateLimited += stats.RateLimited
+		total.RequestSizes.add(stats.RequestSizes)
+		total.ResponseSizes.add(stats.ResponseSizes)
+		total.TotalRSSBytes += stats.TotalRSSBytes
+		total.SpawnDurations.add(stats.SpawnDurations)
+		total.WarmupDurations.add(stats.WarmupDurations)
+	}
+	if total.Requests != 0 {
+		total.AvgLatencyEMA = time.Duration(latencySum / float64(total.Requests))
+	}
+	return total
+}
+
+func (s *PoolSet) weightedShares() map[string]float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := make(map[string]uint64, len(s.weighted))
+	sum := uint64(0)
+	for name, count := range s.weighted {
+		counts[name] = atomic.LoadUint64(count)
+		sum += counts[name]
+	}
+	shares := make(map[string]float64, len(counts))
+	for name, count := range counts {
+		if sum != 0 {
+			shares[name] = float64(count) / float64(sum)
+		}
+	}
+	return shares
+}
+
+func (s *PoolSet) PoolStats() map[string]WorkerPoolStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := make(map[string]WorkerPoolStats, len(s.pools))
+	for name, pool := range s.pools {
+		stats[name] = pool.Stats()
+	}
+	return stats
+}
+
+// Close closes every pool in the set at the same time.
+func (s *PoolSet) Close() map[string]ShutdownReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	reports := make(map[string]ShutdownReport, len(s.pools))
+	for name, pool := range s.pools {
+		name, pool := name, pool
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report := pool.Close()
+			mu.Lock()
+			reports[name] = report
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return reports
+}
@@ -0,0 +1,61 @@
+package poolparty
+
+import (
+	"time"
+)
+
+type recentRequest struct {
+	at       time.Time
+	method   string
+	uri      string
+	duration time.Duration
+	err      error
+	// LogFields of the request, such as a request id.
+	fields []interface{}
+}
+
+// recentRequests remembers the last few requests a worker handled so they
+// can be logged if the worker dies, to help find a request that keeps
+// crashing workers. Bodies are not kept. Only used by the worker goroutine.
+type recentRequests struct {
+	buf  []recentRequest
+	next int
+	full bool
+}
+
+func newRecentRequests(n int) *recentRequests {
+	return &recentRequests{buf: make([]recentRequest, n)}
+}
+
+func (r *recentRequests) add(req recentRequest) {
+	r.buf[r.next] = req
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// dump logs the remembered requests oldest first.
+func (r *recentRequests) dump(logfn func(keyvals ...interface{})) {
+	start, n := 0, r.next
+	if r.full {
+		start, n = r.next, len(r.buf)
+	}
+	for i := 0; i < n; i++ {
+		req := r.buf[(start+i)%len(r.buf)]
+		outcome := "ok"
+		if req.err != nil {
+			outcome = req.err.Error()
+		}
+		kvs := []interface{}{
+			"msg", "request handled by crashed worker",
+			"requests-ago", n - 1 - i,
+			"at", req.at.Format(time.RFC3339Nano),
+			"method", req.method,
+			"uri", req.uri,
+			"duration", req.duration,
+			"outcome", outcome,
+		}
+		logfn(append(kvs, req.fields...)...)
+	}
+}
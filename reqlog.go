@@ -0,0 +1,44 @@
+package poolparty
+
+import (
+	"bytes"
+)
+
+const requestLogTruncated = "... request log truncated\n"
+
+// DispatchWithLogs is like Dispatch but also returns the request's log,
+// the data of every event of kind "log" the worker sent while handling
+// it, one line each. The log is also returned if the handler fails, but
+// not if the request times out. Lines past RequestLogLimit bytes are
+// replaced by a truncation marker. Workers only need to send log
+// events when asked, e.g. by a debug header. Janet handlers send them
+// with (poolparty/request-log "msg"). The events are still passed to
+// OnWorkerEvent. Middleware, SequenceKey, idempotency, sampling,
+// shadowing and the Fallback pool are not applied.
+func (p *WorkerPool) DispatchWithLogs(req HTTPRequest) (HTTPResponse, []byte, error) {
+	if err := p.validateRequest(req); err != nil {
+		return HTTPResponse{}, nil, err
+	}
+	r, err := p.dispatchWork(workRequest{Req: req, CollectLogs: true})
+	return r.Resp, r.Logs, err
+}
+
+// appendRequestLog adds a log line to logs, once logs would exceed limit
+// the line is replaced by a truncation marker and later lines dropped.
+func appendRequestLog(logs []byte, line []byte, limit int) []byte {
+	if len(logs) >= limit || bytes.HasSuffix(logs, []byte(requestLogTruncated)) {
+		return logs
+	}
+	n := len(line)
+	if n == 0 || line[n-1] != '\n' {
+		n += 1
+	}
+	if len(logs)+n > limit {
+		return append(logs, requestLogTruncated...)
+	}
+	logs = append(logs, line...)
+	if n != len(line) {
+		logs = append(logs, '\n')
+	}
+	return logs
+}
@@ -0,0 +1,72 @@
+package poolparty
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// restartGuard counts unplanned worker restarts across the whole pool,
+// see MaxRestartsPerWindow.
+type restartGuard struct {
+	mu sync.Mutex
+	// Failed starts and crashes within the last RestartWindow.
+	restarts []time.Time
+	tripped  bool
+	// Closed and replaced by ResetRestartGuard.
+	reset chan struct{}
+}
+
+// recordRestart counts a worker that crashed or failed to start,
+// returning whether the guard is tripped and a channel closed once it
+// is reset.
+func (p *WorkerPool) recordRestart() (bool, <-chan struct{}) {
+	g := &p.restartGuard
+	g.mu.Lock()
+	now := time.Now()
+	keep := g.restarts[:0]
+	for _, t := range g.restarts {
+		if now.Sub(t) < p.cfg.RestartWindow {
+			keep = append(keep, t)
+		}
+	}
+	g.restarts = append(keep, now)
+	n := len(g.restarts)
+	justTripped := !g.tripped && n > p.cfg.MaxRestartsPerWindow
+	if justTripped {
+		g.tripped = true
+	}
+	tripped, reset := g.tripped, g.reset
+	g.mu.Unlock()
+
+	if justTripped {
+		p.log("msg", "restart guard tripped, workers keep crashing", "restarts", n, "window", p.cfg.RestartWindow, "stop-restarts", p.cfg.StopRestartsOnTrip)
+		if p.cfg.OnWorkerEvent != nil {
+			p.cfg.OnWorkerEvent(HTTPRequest{}, "restart-guard-tripped", []byte(fmt.Sprintf("restarts=%d window=%s", n, p.cfg.RestartWindow)))
+		}
+	}
+	return tripped, reset
+}
+
+// ResetRestartGuard forgets past restarts once the cause of a tripped
+// MaxRestartsPerWindow guard is fixed, workers held back by
+// StopRestartsOnTrip start again straight away.
+func (p *WorkerPool) ResetRestartGuard() {
+	g := &p.restartGuard
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.restarts = nil
+	if g.tripped {
+		g.tripped = false
+		p.log("msg", "restart guard reset")
+	}
+	close(g.reset)
+	g.reset = make(chan struct{})
+}
+
+func (p *WorkerPool) restartGuardTripped() bool {
+	g := &p.restartGuard
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.tripped
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package poolparty
+
+import (
+	"errors"
+)
+
+func workerRSS(pid int) (int64, error) {
+	return 0, errors.New("reading worker memory usage is only supported on linux")
+}
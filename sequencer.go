@@ -0,0 +1,42 @@
+package poolparty
+
+import (
+	"sync"
+)
+
+// sequencer runs callers with the same key one at a time in the order
+// they called acquire.
+type sequencer struct {
+	mu sync.Mutex
+	// The first channel in each queue belongs to the running caller, the
+	// rest wait for the channel before theirs to be closed.
+	queues map[string][]chan struct{}
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{queues: make(map[string][]chan struct{})}
+}
+
+func (s *sequencer) acquire(key string) (release func()) {
+	s.mu.Lock()
+	turn := make(chan struct{})
+	queue := s.queues[key]
+	s.queues[key] = append(queue, turn)
+	s.mu.Unlock()
+
+	if len(queue) != 0 {
+		<-turn
+	}
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		queue := s.queues[key][1:]
+		if len(queue) == 0 {
+			delete(s.queues, key)
+			return
+		}
+		s.queues[key] = queue
+		close(queue[0])
+	}
+}
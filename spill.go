@@ -0,0 +1,201 @@
+package poolparty
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"git.sr.ht/~sircmpwn/go-bare"
+)
+
+// SpillableResponse is a response returned by DispatchSpill. Body must
+// be closed once read.
+type SpillableResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    io.ReadCloser
+}
+
+// DispatchSpill is like Dispatch but returns the body as a reader, and
+// the body of a response larger than SpillThreshold bytes, counting
+// the headers and framing, is written to a temporary file in SpillDir
+// instead of being held in memory. The file is removed as soon as it
+// is created, so its space is released when Body is closed, or when the
+// process exits if it never is. WorkerMaxResponseSize still applies,
+// and may be set above the 32 MiB limit on responses held in memory.
+//
+// If the file can't be created or written the request fails and the
+// worker is restarted, as the rest of its response is left unread.
+// Middleware, SequenceKey, idempotency, sampling, shadowing and the
+// Fallback pool are not applied.
+func (p *WorkerPool) DispatchSpill(req HTTPRequest) (SpillableResponse, error) {
+	if err := p.validateRequest(req); err != nil {
+		return SpillableResponse{}, err
+	}
+	r, err := p.dispatchWork(workRequest{Req: req, Mode: spillResponse})
+	if err != nil {
+		return SpillableResponse{}, err
+	}
+	resp := SpillableResponse{
+		Status:  r.Resp.Status,
+		Headers: r.Resp.Headers,
+	}
+	if r.Spilled != nil {
+		resp.Body = r.Spilled
+	} else {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(r.Resp.Body))
+	}
+	return resp, nil
+}
+
+// workerReadSpillFrame reads a frame like workerReadFrame, except that
+// an HTTPResponse frame larger than SpillThreshold is decoded as it is
+// read, with its body copied to a file. If stream is not nil every
+// HTTPResponse frame is, with its body copied to stream instead. If the
+// frame was neither the returned status is 0 and buf holds the frame.
+func workerReadSpillFrame(p *WorkerPool, in io.Reader, buf *bytes.Buffer, stream *responseStream) (resp HTTPResponse, spilled *os.File, recycle bool, err error) {
+	respLen, err := workerReadFrameLen(p, in)
+	if err != nil {
+		return HTTPResponse{}, nil, false, err
+	}
+	if stream == nil && (p.cfg.SpillThreshold == 0 || int64(respLen) <= p.cfg.SpillThreshold) {
+		err = checkBufferedFrameLen(respLen)
+		if err != nil {
+			return HTTPResponse{}, nil, false, err
+		}
+		return HTTPResponse{}, nil, false, workerReadFrameBody(in, buf, respLen)
+	}
+
+	frame := &io.LimitedReader{R: in, N: int64(respLen)}
+	brdr := bufio.NewReader(frame)
+	br := bare.NewReader(brdr)
+	errCorrupt := errors.New("worker sent a corrupt response")
+
+	variant, err := br.ReadUint()
+	if err != nil {
+		return HTTPResponse{}, nil, false, errCorrupt
+	}
+	if variant != 0 {
+		// Not a response body, keep it in memory as usual.
+		err = checkBufferedFrameLen(respLen)
+		if err != nil {
+			return HTTPResponse{}, nil, false, err
+		}
+		var varintBuf [binary.MaxVarintLen64]byte
+		buf.Reset()
+		buf.Write(varintBuf[:binary.PutUvarint(varintBuf[:], variant)])
+		_, err := buf.ReadFrom(brdr)
+		if err != nil {
+			return HTTPResponse{}, nil, false, fmt.Errorf("unable to read response: %w", err)
+		}
+		if frame.N != 0 {
+			return HTTPResponse{}, nil, false, fmt.Errorf("response truncated after %d of %d bytes", int64(respLen)-frame.N, respLen)
+		}
+		return HTTPResponse{}, nil, false, nil
+	}
+
+	status, err := br.ReadUint()
+	if err != nil {
+		return HTTPResponse{}, nil, false, errCorrupt
+	}
+	numHeaders, err := br.ReadUint()
+	if err != nil {
+		return HTTPResponse{}, nil, false, errCorrupt
+	}
+	headers := make(map[string][]string)
+	for i := uint64(0); i < numHeaders; i++ {
+		hdr, err := br.ReadString()
+		if err != nil {
+			return HTTPResponse{}, nil, false, errCorrupt
+		}
+		numValues, err := br.ReadUint()
+		if err != nil {
+			return HTTPResponse{}, nil, false, errCorrupt
+		}
+		values := []string{}
+		for j := uint64(0); j < numValues; j++ {
+			value, err := br.ReadString()
+			if err != nil {
+				return HTTPResponse{}, nil, false, errCorrupt
+			}
+			values = append(values, value)
+		}
+		headers[hdr] = values
+	}
+	bodyLen, err := br.ReadUint()
+	if err != nil || bodyLen > uint64(frame.N)+uint64(brdr.Buffered()) {
+		return HTTPResponse{}, nil, false, errCorrupt
+	}
+
+	if stream != nil {
+		validStatus := status >= 100 && status <= 999
+		if validStatus {
+			stream.start(int(status), headers)
+		}
+		var dst io.Writer = stream
+		if !validStatus {
+			dst = ioutil.Discard
+		}
+		_, err = io.CopyN(dst, brdr, int64(bodyLen))
+		if err != nil {
+			return HTTPResponse{}, nil, false, fmt.Errorf("unable to stream response: %w", err)
+		}
+		recycle, _ = br.ReadBool()
+		_, err = io.Copy(ioutil.Discard, brdr)
+		if err != nil {
+			return HTTPResponse{}, nil, false, fmt.Errorf("unable to read response: %w", err)
+		}
+		if frame.N != 0 {
+			return HTTPResponse{}, nil, false, fmt.Errorf("response truncated after %d of %d bytes", int64(respLen)-frame.N, respLen)
+		}
+		p.responseSizes.record(respLen + 4)
+		if !validStatus {
+			return HTTPResponse{}, nil, recycle, fmt.Errorf("%w: status %d", ErrInvalidResponse, status)
+		}
+		return HTTPResponse{Status: int(status), Headers: headers}, nil, recycle, nil
+	}
+
+	f, err := ioutil.TempFile(p.cfg.SpillDir, "poolparty-response-")
+	if err != nil {
+		return HTTPResponse{}, nil, false, fmt.Errorf("unable to spill response: %w", err)
+	}
+	// Unlinked right away so the file can't outlive whoever holds it.
+	_ = os.Remove(f.Name())
+	ok := false
+	defer func() {
+		if !ok {
+			_ = f.Close()
+		}
+	}()
+
+	_, err = io.CopyN(f, brdr, int64(bodyLen))
+	if err != nil {
+		return HTTPResponse{}, nil, false, fmt.Errorf("unable to spill response: %w", err)
+	}
+	// Workers predating recycle requests don't send this field.
+	recycle, _ = br.ReadBool()
+	_, err = io.Copy(ioutil.Discard, brdr)
+	if err != nil {
+		return HTTPResponse{}, nil, false, fmt.Errorf("unable to read response: %w", err)
+	}
+	if frame.N != 0 {
+		return HTTPResponse{}, nil, false, fmt.Errorf("response truncated after %d of %d bytes", int64(respLen)-frame.N, respLen)
+	}
+	p.responseSizes.record(respLen + 4)
+
+	if status < 100 || status > 999 {
+		return HTTPResponse{}, nil, recycle, fmt.Errorf("%w: status %d", ErrInvalidResponse, status)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return HTTPResponse{}, nil, false, fmt.Errorf("unable to spill response: %w", err)
+	}
+
+	ok = true
+	return HTTPResponse{Status: int(status), Headers: headers}, f, recycle, nil
+}
@@ -0,0 +1,150 @@
+package poolparty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// DispatchTo is like Dispatch but copies the response body straight
+// from the worker into w as it is read, rather than holding it in
+// memory. If w is an http.ResponseWriter the status and headers are
+// set on it before the body is written. The returned headers don't
+// include the body. WorkerMaxResponseSize still applies, and may be
+// set above the 32 MiB limit on responses held in memory.
+//
+// If writing to w fails, or ctx is done, the request is cancelled like
+// CancelWhere would, so the worker is stopped and replaced, and the
+// error is returned. A write to w that already started is waited for,
+// so w is never used once DispatchTo has returned, but a w that can
+// block forever must be unblocked some other way, e.g. by a write
+// deadline. Middleware, SequenceKey, idempotency, sampling, shadowing
+// and the Fallback pool are not applied.
+func (p *WorkerPool) DispatchTo(ctx context.Context, req HTTPRequest, w io.Writer) (int, map[string][]string, error) {
+	if err := p.validateRequest(req); err != nil {
+		return 0, nil, err
+	}
+	stream := &responseStream{ctx: ctx, w: w}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.fail(ctx.Err())
+		case <-done:
+		}
+	}()
+	r, err := p.dispatchWork(workRequest{Req: req, Mode: streamResponse, Stream: stream})
+	close(done)
+	werr := stream.finish()
+	if werr != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(werr, ctxErr) {
+			return 0, nil, ctxErr
+		}
+		return r.Resp.Status, r.Resp.Headers, fmt.Errorf("unable to write response: %w", werr)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return r.Resp.Status, r.Resp.Headers, nil
+}
+
+var errStreamFinished = errors.New("DispatchTo already returned")
+
+// responseStream receives a response body for DispatchTo. Only the
+// worker goroutine writes, but the caller may stop waiting for it, see
+// finish. The lock is never held while calling w, so fail can cancel
+// the request while a write is blocked.
+type responseStream struct {
+	ctx context.Context
+	w   io.Writer
+
+	mu       sync.Mutex
+	err      error
+	finished bool
+	// Calls to w in progress, only added to before finished is set.
+	using sync.WaitGroup
+	// Set by dispatchWork, see fail.
+	inflight *inflightRequest
+}
+
+func (s *responseStream) setInflight(r *inflightRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight = r
+}
+
+// fail records the first error and cancels the request, so the caller
+// is answered and the worker stopped even while a write is blocked.
+func (s *responseStream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	r := s.inflight
+	s.mu.Unlock()
+	if r != nil {
+		r.cancel()
+	}
+}
+
+// use reserves w for a call, it must be followed by s.using.Done().
+func (s *responseStream) use() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return errStreamFinished
+	}
+	if s.err != nil {
+		return s.err
+	}
+	s.using.Add(1)
+	return nil
+}
+
+// start sets the status and headers on an http.ResponseWriter.
+func (s *responseStream) start(status int, headers map[string][]string) {
+	rw, ok := s.w.(http.ResponseWriter)
+	if !ok || s.use() != nil {
+		return
+	}
+	defer s.using.Done()
+	for hdr, values := range headers {
+		for _, value := range values {
+			rw.Header().Add(hdr, value)
+		}
+	}
+	rw.WriteHeader(status)
+}
+
+func (s *responseStream) Write(b []byte) (int, error) {
+	err := s.use()
+	if err != nil {
+		return 0, err
+	}
+	defer s.using.Done()
+	if err := s.ctx.Err(); err != nil {
+		s.fail(err)
+		return 0, err
+	}
+	_, err = s.w.Write(b)
+	if err != nil {
+		s.fail(err)
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// finish stops later writes reaching w, waits for any in progress and
+// returns the first error writing to it.
+func (s *responseStream) finish() error {
+	s.mu.Lock()
+	s.finished = true
+	s.mu.Unlock()
+	s.using.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
@@ -0,0 +1,73 @@
+package poolparty
+
+import (
+	"sync"
+	"time"
+)
+
+// Usage is the work done by workers for requests with one UsageTag.
+type Usage struct {
+	Requests uint64
+	// Time from a worker taking each request until its response.
+	ExecTime time.Duration
+}
+
+type usageMeter struct {
+	mu      sync.Mutex
+	maxTags int
+	usage   map[string]Usage
+}
+
+func newUsageMeter(maxTags int) *usageMeter {
+	return &usageMeter{
+		maxTags: maxTags,
+		usage:   make(map[string]Usage),
+	}
+}
+
+func (m *usageMeter) add(tag string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.usage[tag]
+	if !ok && len(m.usage) >= m.maxTags {
+		tag = ""
+		u = m.usage[tag]
+	}
+	u.Requests += 1
+	u.ExecTime += d
+	m.usage[tag] = u
+}
+
+func (m *usageMeter) snapshot(reset bool) map[string]Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if reset {
+		usage := m.usage
+		m.usage = make(map[string]Usage)
+		return usage
+	}
+	usage := make(map[string]Usage, len(m.usage))
+	for tag, u := range m.usage {
+		usage[tag] = u
+	}
+	return usage
+}
+
+// UsageByTag returns the accumulated usage for each tag returned by
+// UsageTag. Once MaxUsageTags tags are tracked, requests with new tags
+// are counted under the empty tag. It returns nil if UsageTag is not set.
+func (p *WorkerPool) UsageByTag() map[string]Usage {
+	if p.usage == nil {
+		return nil
+	}
+	return p.usage.snapshot(false)
+}
+
+// ResetUsage is like UsageByTag but also starts counting again from
+// zero, no request is counted in both the returned usage and the next.
+func (p *WorkerPool) ResetUsage() map[string]Usage {
+	if p.usage == nil {
+		return nil
+	}
+	return p.usage.snapshot(true)
+}
@@ -0,0 +1,49 @@
+package poolparty
+
+import (
+	"context"
+)
+
+// activeState counts requests that are queued, being handled by a worker
+// or both, which InFlight alone doesn't cover as a caller that timed out
+// stops counting while its worker may still be busy with the request.
+type activeState struct {
+	n int
+	// Made by WaitIdle, closed when n drops to 0.
+	quiet chan struct{}
+}
+
+func (p *WorkerPool) addActive(delta int) {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	p.active.n += delta
+	if p.active.n == 0 && p.active.quiet != nil {
+		close(p.active.quiet)
+		p.active.quiet = nil
+	}
+}
+
+// WaitIdle blocks until no requests are queued and no worker is handling
+// a request, or ctx is done. It returns as soon as the pool is idle at
+// any point, requests dispatched during the wait delay it, so under
+// steady load it may never return, and requests dispatched after it
+// returns are not waited for. Health checks are not counted.
+func (p *WorkerPool) WaitIdle(ctx context.Context) error {
+	p.activeMu.Lock()
+	if p.active.n == 0 {
+		p.activeMu.Unlock()
+		return nil
+	}
+	if p.active.quiet == nil {
+		p.active.quiet = make(chan struct{})
+	}
+	quiet := p.active.quiet
+	p.activeMu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-quiet:
+		return nil
+	}
+}
@@ -0,0 +1,58 @@
+package poolparty
+
+import (
+	"os"
+	"time"
+)
+
+type watchedFile struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func statWatchPaths(paths []string) []watchedFile {
+	files := make([]watchedFile, len(paths))
+	for i, path := range paths {
+		st, err := os.Stat(path)
+		if err == nil {
+			files[i] = watchedFile{exists: true, size: st.Size(), modTime: st.ModTime()}
+		}
+	}
+	return files
+}
+
+// watchPaths polls WatchPaths every WatchInterval and restarts all
+// workers once the files have stopped changing for WatchDebounce, so a
+// burst of edits causes a single restart.
+func (p *WorkerPool) watchPaths() {
+	ticker := time.NewTicker(p.cfg.WatchInterval)
+	defer ticker.Stop()
+
+	last := statWatchPaths(p.cfg.WatchPaths)
+	var lastChange time.Time
+	pending := false
+	for {
+		select {
+		case <-p.workerCtx.Done():
+			return
+		case now := <-ticker.C:
+			current := statWatchPaths(p.cfg.WatchPaths)
+			for i := range current {
+				if current[i] != last[i] {
+					lastChange = now
+					pending = true
+				}
+			}
+			last = current
+			if pending && now.Sub(lastChange) >= p.cfg.WatchDebounce {
+				pending = false
+				p.log("msg", "watched file changed, restarting workers")
+				err := p.RestartWorkers(p.workerCtx)
+				if err != nil && p.workerCtx.Err() == nil {
+					p.log("msg", "unable to restart workers", "err", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package poolparty
+
+import (
+	"sync"
+	"time"
+)
+
+// WorkerStats describes one worker slot, see WorkerStats.
+type WorkerStats struct {
+	ID int
+	// Zero while the slot's worker is starting or restarting.
+	Pid      int
+	Requests uint64
+	// The slot's most recent failed request, crash or failure to
+	// start. Cleared once LastErrorClearAfter requests in a row have
+	// succeeded.
+	LastError     string
+	LastErrorTime time.Time
+}
+
+// workerSlotStats outlives the slot's worker processes so a crash
+// stays visible once the worker is replaced.
+type workerSlotStats struct {
+	mu            sync.Mutex
+	pid           int
+	requests      uint64
+	lastError     string
+	lastErrorTime time.Time
+	// Successful requests since lastError.
+	succeeded int
+}
+
+func (s *workerSlotStats) setPid(pid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pid = pid
+}
+
+func (s *workerSlotStats) recordError(err string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err
+	s.lastErrorTime = time.Now()
+	s.succeeded = 0
+}
+
+func (s *workerSlotStats) recordRequest(err error, clearAfter int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests += 1
+	if err != nil {
+		s.lastError = err.Error()
+		s.lastErrorTime = time.Now()
+		s.succeeded = 0
+		return
+	}
+	s.succeeded += 1
+	if clearAfter > 0 && s.succeeded >= clearAfter {
+		s.lastError = ""
+		s.lastErrorTime = time.Time{}
+	}
+}
+
+// slotStatsSnapshot returns the stats of each worker slot by id. The
+// slice is only ever replaced, under mu, never changed in place, so it
+// can be read without mu, which RestartWorkers and friends hold for a
+// long time.
+func (p *WorkerPool) slotStatsSnapshot() []*workerSlotStats {
+	slots, _ := p.slotStats.Load().([]*workerSlotStats)
+	return slots
+}
+
+// WorkerStats returns the stats of each worker slot by id, as used by
+// QuiesceWorker and DispatchToWorker.
+func (p *WorkerPool) WorkerStats() []WorkerStats {
+	slots := p.slotStatsSnapshot()
+	stats := make([]WorkerStats, len(slots))
+	for i, s := range slots {
+		s.mu.Lock()
+		stats[i] = WorkerStats{
+			ID:            i,
+			Pid:           s.pid,
+			Requests:      s.requests,
+			LastError:     s.lastError,
+			LastErrorTime: s.lastErrorTime,
+		}
+		s.mu.Unlock()
+	}
+	return stats
+}